@@ -0,0 +1,203 @@
+package main
+
+import (
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// singleByteCharsets maps the upper half (0x80-0xFF) of the legacy
+// single-byte charsets we can convert to UTF-8
+var singleByteCharsets = map[string]*[128]rune{
+	"iso-8859-1":   latin1Table(nil),
+	"iso-8859-15":  latin1Table(map[byte]rune{0xA4: '€', 0xA6: 'Š', 0xA8: 'š', 0xB4: 'Ž', 0xB8: 'ž', 0xBC: 'Œ', 0xBD: 'œ', 0xBE: 'Ÿ'}),
+	"windows-1252": latin1Table(windows1252Specials),
+	"iso-8859-2":   upperHalfTable("\u0080\u0081\u0082\u0083\u0084\u0085\u0086\u0087\u0088\u0089\u008a\u008b\u008c\u008d\u008e\u008f\u0090\u0091\u0092\u0093\u0094\u0095\u0096\u0097\u0098\u0099\u009a\u009b\u009c\u009d\u009e\u009f\u00a0Ą˘Ł¤ĽŚ§¨ŠŞŤŹ\u00adŽŻ°ą˛ł´ľśˇ¸šşťź˝žżŔÁÂĂÄĹĆÇČÉĘËĚÍÎĎĐŃŇÓÔŐÖ×ŘŮÚŰÜÝŢßŕáâăäĺćçčéęëěíîďđńňóôőö÷řůúűüýţ˙"),
+	"iso-8859-5":   upperHalfTable("\u0080\u0081\u0082\u0083\u0084\u0085\u0086\u0087\u0088\u0089\u008a\u008b\u008c\u008d\u008e\u008f\u0090\u0091\u0092\u0093\u0094\u0095\u0096\u0097\u0098\u0099\u009a\u009b\u009c\u009d\u009e\u009f\u00a0ЁЂЃЄЅІЇЈЉЊЋЌ\u00adЎЏАБВГДЕЖЗИЙКЛМНОПРСТУФХЦЧШЩЪЫЬЭЮЯабвгдежзийклмнопрстуфхцчшщъыьэюя№ёђѓєѕіїјљњћќ§ўџ"),
+	"windows-1251": upperHalfTable("ЂЃ‚ѓ„…†‡€‰Љ‹ЊЌЋЏђ‘’“”•–—\u0098™љ›њќћџ\u00a0ЎўЈ¤Ґ¦§Ё©Є«¬\u00ad®Ї°±Ііґµ¶·ё№є»јЅѕїАБВГДЕЖЗИЙКЛМНОПРСТУФХЦЧШЩЪЫЬЭЮЯабвгдежзийклмнопрстуфхцчшщъыьэюя"),
+}
+
+// windows1252Specials are the printable characters Windows-1252 puts in
+// the C1 range; the five unassigned bytes keep their Latin-1 meaning
+var windows1252Specials = map[byte]rune{
+	0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡',
+	0x88: 'ˆ', 0x89: '‰', 0x8A: 'Š', 0x8B: '‹', 0x8C: 'Œ', 0x8E: 'Ž',
+	0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—',
+	0x98: '˜', 0x99: '™', 0x9A: 'š', 0x9B: '›', 0x9C: 'œ', 0x9E: 'ž', 0x9F: 'Ÿ',
+}
+
+// charsetAliases maps other common names to the ones used here
+var charsetAliases = map[string]string{
+	"utf8":        "utf-8",
+	"ascii":       "us-ascii",
+	"latin1":      "iso-8859-1",
+	"iso8859-1":   "iso-8859-1",
+	"iso_8859-1":  "iso-8859-1",
+	"latin-9":     "iso-8859-15",
+	"iso8859-15":  "iso-8859-15",
+	"iso_8859-15": "iso-8859-15",
+	"latin2":      "iso-8859-2",
+	"iso8859-2":   "iso-8859-2",
+	"iso_8859-2":  "iso-8859-2",
+	"iso8859-5":   "iso-8859-5",
+	"iso_8859-5":  "iso-8859-5",
+	"cp1251":      "windows-1251",
+	"cp1252":      "windows-1252",
+	"sjis":        "shift_jis",
+	"shift-jis":   "shift_jis",
+	"ms_kanji":    "shift_jis",
+	"cp932":       "shift_jis",
+	"windows-31j": "shift_jis",
+}
+
+// latin1Table returns the ISO-8859-1 upper half with some bytes replaced
+func latin1Table(overrides map[byte]rune) *[128]rune {
+	var table [128]rune
+	for i := range table {
+		table[i] = rune(0x80 + i)
+	}
+	for b, r := range overrides {
+		table[b-0x80] = r
+	}
+	return &table
+}
+
+// upperHalfTable builds a table from the 128 characters for bytes 0x80-0xFF
+func upperHalfTable(chars string) *[128]rune {
+	var table [128]rune
+	runes := []rune(chars)
+	if len(runes) != len(table) {
+		panic("charset table must have 128 characters")
+	}
+	copy(table[:], runes)
+	return &table
+}
+
+// canonicalCharset lowercases a charset name and resolves aliases
+func canonicalCharset(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := charsetAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// decodeCharset makes a body fit to send. Valid UTF-8 is returned as is.
+// Otherwise the body is taken to be in the declared charset, if it fits,
+// or in the one detectCharset guesses, and converted to UTF-8 when that is a
+// single-byte charset we know. Anything else is returned unchanged along
+// with its charset, for the caller to label and send as binary.
+func decodeCharset(body, declared string) (text, charset string) {
+	if utf8.ValidString(body) {
+		return body, "utf-8"
+	}
+
+	// The declared charset usually comes from the top-level headers rather
+	// than the part itself, so it is not trusted when the body contradicts it
+	charset = canonicalCharset(declared)
+	switch {
+	case charset == "", charset == "utf-8", charset == "us-ascii",
+		charset == "shift_jis" && !looksLikeShiftJIS(body):
+		charset = detectCharset(body)
+	}
+	table, ok := singleByteCharsets[charset]
+	if !ok {
+		return body, charset
+	}
+
+	var b strings.Builder
+	b.Grow(len(body) + len(body)/2)
+	for i := 0; i < len(body); i++ {
+		if c := body[i]; c < 0x80 {
+			b.WriteByte(c)
+		} else {
+			b.WriteRune(table[c-0x80])
+		}
+	}
+	return b.String(), "utf-8"
+}
+
+// detectCharset guesses the charset of text that isn't UTF-8: Shift_JIS
+// when it is well-formed Shift_JIS made mostly of the common kana and kanji
+// rows, Windows-1251 when most letters are Cyrillic, and Windows-1252,
+// which accepts any byte, otherwise.
+func detectCharset(body string) string {
+	if looksLikeShiftJIS(body) {
+		return "shift_jis"
+	}
+
+	// Cyrillic text in Windows-1251 is mostly letters from 0xC0-0xFF, while
+	// Western European text only has the odd accented letter
+	var cyrillic, letters int
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c >= 0xC0:
+			cyrillic++
+			letters++
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			letters++
+		}
+	}
+	if letters > 0 && cyrillic*2 > letters {
+		return "windows-1251"
+	}
+	return "windows-1252"
+}
+
+// looksLikeShiftJIS reports whether every multi-byte sequence in body is
+// valid Shift_JIS and most of them use the lead bytes of kana and common
+// kanji (0x81-0x9F), which single-byte text rarely produces.
+func looksLikeShiftJIS(body string) bool {
+	var pairs, commonLeads int
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c < 0x80, c >= 0xA1 && c <= 0xDF:
+			// ASCII or half-width katakana
+		case c >= 0x81 && c <= 0x9F, c >= 0xE0 && c <= 0xFC:
+			if i+1 >= len(body) {
+				return false
+			}
+			trail := body[i+1]
+			if trail < 0x40 || trail == 0x7F || trail > 0xFC {
+				return false
+			}
+			pairs++
+			if c <= 0x9F {
+				commonLeads++
+			}
+			i++
+		default:
+			return false
+		}
+	}
+	return pairs > 0 && commonLeads*2 > pairs
+}
+
+// declaredCharset returns the charset parameter of the Content-Type in the
+// payload's headers, which mailparser gives either as a string or as a
+// {"value":..., "params":{...}} object
+func declaredCharset(headers interface{}) string {
+	fields, ok := headers.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for name, value := range fields {
+		if !strings.EqualFold(name, "content-type") {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			if _, params, err := mime.ParseMediaType(v); err == nil {
+				return params["charset"]
+			}
+		case map[string]interface{}:
+			if params, ok := v["params"].(map[string]interface{}); ok {
+				charset, _ := params["charset"].(string)
+				return charset
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeCharset(t *testing.T) {
+	tests := []struct {
+		name, body, declared string
+		want, wantCharset    string
+	}{
+		{"utf-8", "café", "", "café", "utf-8"},
+		{"latin-1 guessed", "caf\xe9 cr\xe8me", "", "café crème", "utf-8"},
+		{"windows-1252 quotes", "\x93smart\x94", "", "“smart”", "utf-8"},
+		{"windows-1251 guessed", "\xcf\xf0\xe8\xe2\xe5\xf2 \xec\xe8\xf0", "", "Привет мир", "utf-8"},
+		{"iso-8859-2 declared", "\xb1\xb6", "ISO-8859-2", "ąś", "utf-8"},
+		{"shift_jis kept", "\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd", "", "\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd", "shift_jis"},
+		{"unknown declared kept", "\xb1\xb6", "big5", "\xb1\xb6", "big5"},
+	}
+	for _, tt := range tests {
+		got, charset := decodeCharset(tt.body, tt.declared)
+		if got != tt.want || charset != tt.wantCharset {
+			t.Errorf("%s: decodeCharset = %q, %s; want %q, %s", tt.name, got, charset, tt.want, tt.wantCharset)
+		}
+	}
+}
+
+func TestDecodePayloadKeepsRawBodyBytes(t *testing.T) {
+	// Legacy bytes straight in the JSON, which encoding/json would turn into
+	// U+FFFD; the declared Shift_JIS only fits the HTML
+	body := "{\"text\":\"caf\xe9\\n\\\"x\\\"\",\"html\":\"<p>\x82\xb1\x82\xf1</p>\"," +
+		"\"headers\":{\"content-type\":{\"value\":\"text/plain\",\"params\":{\"charset\":\"shift_jis\"}}}}"
+	var payload WebhookPayload
+	if err := decodePayload(strings.NewReader(body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Text != "café\n\"x\"" || payload.textCharset != "utf-8" {
+		t.Errorf("text = %q (%s)", payload.Text, payload.textCharset)
+	}
+	if payload.HTML != "<p>\x82\xb1\x82\xf1</p>" || payload.htmlCharset != "shift_jis" {
+		t.Errorf("html = %q (%s)", payload.HTML, payload.htmlCharset)
+	}
+
+	// Escapes, including surrogate pairs and a lone surrogate
+	payload = WebhookPayload{}
+	body = `{"text":"\u00e9\ud83d\ude00 \ud83d\/"}`
+	if err := decodePayload(strings.NewReader(body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Text != "é😀 \uFFFD/" {
+		t.Errorf("text = %q", payload.Text)
+	}
+}
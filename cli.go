@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runCommand runs a dead-letter management subcommand and returns the exit code
+func runCommand(name string, args []string) int {
+	var err error
+	switch name {
+	case "list-failed":
+		err = cmdListFailed(args)
+	case "show":
+		err = cmdShow(args)
+	case "replay":
+		err = cmdReplay(args)
+	case "purge":
+		err = cmdPurge(args)
+	case "help", "-h", "-help", "--help":
+		printUsage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+		printUsage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, `Usage: web2mail [command] [options]
+
+Without a command the webhook server is started. Commands operate on the
+failed deliveries kept in DELIVERY_STORE_DIR:
+
+  list-failed [filters]        List failed deliveries
+  show <id>                    Show a failed delivery and its stored message
+  replay [filters] [id...]     Redeliver with the current backend configuration
+  purge [filters] [id...]      Delete failed deliveries (-all to purge everything)
+
+Filters:
+  -from <address>   Envelope sender
+  -to <address>     Envelope recipient
+  -since <time>     Created at or after (RFC 3339, YYYY-MM-DD, or a duration like 24h)
+  -until <time>     Created at or before
+`)
+}
+
+// filterFlags registers the common filter flags on fs
+func filterFlags(fs *flag.FlagSet) func() (DeliveryFilter, error) {
+	from := fs.String("from", "", "envelope sender")
+	to := fs.String("to", "", "envelope recipient")
+	since := fs.String("since", "", "created at or after")
+	until := fs.String("until", "", "created at or before")
+
+	return func() (DeliveryFilter, error) {
+		filter := DeliveryFilter{Status: StatusFailed, From: *from, To: *to}
+		var err error
+		if filter.Since, err = parseTimeFlag(*since); err != nil {
+			return filter, fmt.Errorf("invalid -since: %v", err)
+		}
+		if filter.Until, err = parseTimeFlag(*until); err != nil {
+			return filter, fmt.Errorf("invalid -until: %v", err)
+		}
+		return filter, nil
+	}
+}
+
+// parseTimeFlag accepts RFC 3339, a date, or a duration counted back from now
+func parseTimeFlag(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", value)
+}
+
+// openDeadLetters opens the delivery store, which must be on disk
+func openDeadLetters() (*DeliveryStore, error) {
+	if os.Getenv("DELIVERY_STORE_DIR") == "" {
+		return nil, fmt.Errorf("DELIVERY_STORE_DIR is not set")
+	}
+	return openDeliveryStore()
+}
+
+// selectFailed returns the failed deliveries named by ids, or matching filter when no ids are given
+func selectFailed(store *DeliveryStore, filter DeliveryFilter, ids []string) ([]DeliveryRecord, error) {
+	if len(ids) == 0 {
+		return store.List(filter), nil
+	}
+	var records []DeliveryRecord
+	for _, id := range ids {
+		rec, ok := store.Get(id)
+		if !ok {
+			return nil, fmt.Errorf("delivery %s not found", id)
+		}
+		if rec.Status != StatusFailed {
+			return nil, fmt.Errorf("delivery %s has status %s, not %s", id, rec.Status, StatusFailed)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func cmdListFailed(args []string) error {
+	fs := flag.NewFlagSet("list-failed", flag.ExitOnError)
+	getFilter := filterFlags(fs)
+	fs.Parse(args)
+	filter, err := getFilter()
+	if err != nil {
+		return err
+	}
+	store, err := openDeadLetters()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCREATED\tFROM\tTO\tATTEMPTS\tSUBJECT\tLAST ERROR")
+	for _, rec := range store.List(filter) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			rec.ID, rec.CreatedAt.Local().Format("2006-01-02 15:04"), rec.From, rec.To,
+			rec.Attempts, truncate(rec.Subject, 40), truncate(rec.LastError, 60))
+	}
+	return tw.Flush()
+}
+
+func cmdShow(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: show <id>")
+	}
+	store, err := openDeadLetters()
+	if err != nil {
+		return err
+	}
+
+	rec, ok := store.Get(args[0])
+	if !ok {
+		return fmt.Errorf("delivery %s not found", args[0])
+	}
+	out, _ := json.MarshalIndent(rec, "", "  ")
+	fmt.Printf("%s\n\n", out)
+
+	msg, _, err := store.LoadDeadLetter(rec.ID)
+	if err != nil {
+		return err
+	}
+	_, err = msg.WriteTo(os.Stdout)
+	return err
+}
+
+func cmdReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	getFilter := filterFlags(fs)
+	fs.Parse(args)
+	filter, err := getFilter()
+	if err != nil {
+		return err
+	}
+	store, err := openDeadLetters()
+	if err != nil {
+		return err
+	}
+	records, err := selectFailed(store, filter, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	_, backend := configureBackend()
+	failed := 0
+	for _, rec := range records {
+		if err := replayDelivery(store, backend, rec); err != nil {
+			fmt.Printf("%s  failed: %v\n", rec.ID, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s  delivered to %s\n", rec.ID, rec.To)
+	}
+
+	fmt.Printf("Replayed %d of %d deliveries\n", len(records)-failed, len(records))
+	if failed > 0 {
+		return fmt.Errorf("%d deliveries failed again", failed)
+	}
+	return nil
+}
+
+// replayDelivery redelivers a stored message and updates its record
+func replayDelivery(store *DeliveryStore, backend Backend, rec DeliveryRecord) error {
+	msg, rawBody, err := store.LoadDeadLetter(rec.ID)
+	if err != nil {
+		return err
+	}
+
+	var payload *WebhookPayload
+	if rawBody != nil {
+		payload = &WebhookPayload{}
+		if err := decodePayload(bytes.NewReader(rawBody), payload); err != nil {
+			payload = nil
+		}
+	}
+
+	// Only the recipients the message did not reach, blind copies included
+	recipients := rec.Pending
+	if len(recipients) == 0 {
+		recipients = []string{rec.To}
+	}
+	done := map[string]bool{}
+	err = deliverEnvelope(backend, rawBody, payload, rec.From, recipients, done, msg)
+	store.RecordAttempt(rec.ID, err, false)
+	store.SetPending(rec.ID, pendingRecipients(recipients, done))
+	if err != nil {
+		return err
+	}
+	store.DeleteDeadLetter(rec.ID)
+	return nil
+}
+
+func cmdPurge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	getFilter := filterFlags(fs)
+	all := fs.Bool("all", false, "purge every failed delivery")
+	fs.Parse(args)
+	filter, err := getFilter()
+	if err != nil {
+		return err
+	}
+	if filter == (DeliveryFilter{Status: StatusFailed}) && fs.NArg() == 0 && !*all {
+		return fmt.Errorf("refusing to purge everything without -all")
+	}
+	store, err := openDeadLetters()
+	if err != nil {
+		return err
+	}
+	records, err := selectFailed(store, filter, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		store.Delete(rec.ID)
+	}
+	fmt.Printf("Purged %d failed deliveries\n", len(records))
+	return nil
+}
+
+// truncate shortens s to at most n runes for tabular output
+func truncate(s string, n int) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilterFlags(t *testing.T) {
+	store, err := NewDeliveryStore("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(d int) time.Time { return time.Date(2026, 1, d, 12, 0, 0, 0, time.UTC) }
+	for _, rec := range []DeliveryRecord{
+		{ID: "a", From: "alice@example.com", To: "rcpt@example.com", Status: StatusFailed, CreatedAt: day(1)},
+		{ID: "b", From: "bob@example.com", To: "rcpt@example.com", Status: StatusFailed, CreatedAt: day(2)},
+		{ID: "c", From: "alice@example.com", To: "other@example.com", Status: StatusFailed, CreatedAt: day(3)},
+		{ID: "d", From: "alice@example.com", To: "rcpt@example.com", Status: StatusDelivered, CreatedAt: day(2)},
+	} {
+		rec := rec
+		store.records[rec.ID] = &rec
+	}
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"a", "b", "c"}},
+		{[]string{"-from", "ALICE@example.com"}, []string{"a", "c"}},
+		{[]string{"-to", "rcpt@example.com"}, []string{"a", "b"}},
+		{[]string{"-since", "2026-01-02T00:00:00Z"}, []string{"b", "c"}},
+		{[]string{"-until", "2026-01-02T23:00:00Z"}, []string{"a", "b"}},
+		{[]string{"-from", "alice@example.com", "-since", "2026-01-02T00:00:00Z", "-until", "2026-01-04T00:00:00Z"}, []string{"c"}},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		getFilter := filterFlags(fs)
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		filter, err := getFilter()
+		if err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		var got []string
+		for _, rec := range store.List(filter) {
+			got = append(got, rec.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v selected %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParseTimeFlag(t *testing.T) {
+	if got, err := parseTimeFlag("2026-01-02"); err != nil || !got.Equal(time.Date(2026, 1, 2, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("date: %v, %v", got, err)
+	}
+	if got, err := parseTimeFlag("24h"); err != nil || time.Since(got) < 24*time.Hour || time.Since(got) > 25*time.Hour {
+		t.Errorf("duration: %v, %v", got, err)
+	}
+	if _, err := parseTimeFlag("yesterday"); err == nil {
+		t.Error("accepted an unrecognized time")
+	}
+}
+
+func TestPurgeRequiresAll(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DELIVERY_STORE_DIR", dir)
+	store, err := NewDeliveryStore(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Create(&DeliveryRecord{ID: testTrackingID, To: "rcpt@example.com", Status: StatusFailed})
+	store.SaveDeadLetter(testTrackingID, bytesMessage("Subject: hi\r\n\r\nhello\r\n"), nil)
+
+	if err := cmdPurge(nil); err == nil {
+		t.Fatal("purge without filters or -all succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, testTrackingID+".eml")); err != nil {
+		t.Fatalf("refused purge removed the dead letter: %v", err)
+	}
+
+	if err := cmdPurge([]string{"-all"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{".json", ".eml"} {
+		if _, err := os.Stat(filepath.Join(dir, testTrackingID+ext)); !os.IsNotExist(err) {
+			t.Errorf("%s after purge -all: %v", ext, err)
+		}
+	}
+}
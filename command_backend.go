@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// CommandBackend pipes the message into a local command such as sendmail,
+// procmail, maildrop or dovecot-lda. Each element of Args may contain the
+// envelope variables {sender}, {recipient}, {local}, {domain} and {subject};
+// they are substituted per argument, so values never split into extra
+// arguments and no shell is involved. An argument that is exactly
+// {recipients} expands to one argument per envelope recipient.
+type CommandBackend struct {
+	Args []string
+	// Timeout kills the command if it runs longer (0 means no limit)
+	Timeout time.Duration
+	// Env is added to the inherited environment, as "KEY=VALUE" entries
+	Env []string
+	// TemporaryExitCodes maps exit codes to temporary (true) or permanent
+	// (false) failure; codes not listed are permanent.
+	TemporaryExitCodes map[int]bool
+}
+
+// NewSendmailBackend returns a CommandBackend that runs sendmail with the
+// envelope recipients on the command line. Recipients are never read from
+// the headers (-t), which would mail Cc addresses again and skip blind copies.
+func NewSendmailBackend(path string, timeout time.Duration) *CommandBackend {
+	return &CommandBackend{
+		Args:               []string{path, "-i", "-f", "{sender}", "--", "{recipients}"},
+		Timeout:            timeout,
+		TemporaryExitCodes: defaultTemporaryExitCodes(),
+	}
+}
+
+// CommandError reports a command that failed, with the exit code and
+// whether the failure is worth retrying.
+type CommandError struct {
+	Command   string
+	ExitCode  int
+	Temporary bool
+	Stderr    string
+	Err       error
+}
+
+func (e *CommandError) Error() string {
+	kind := "permanent"
+	if e.Temporary {
+		kind = "temporary"
+	}
+	code := strconv.Itoa(e.ExitCode)
+	if name, ok := sysexitNames[e.ExitCode]; ok {
+		code += " " + name
+	}
+	return fmt.Sprintf("%s failed (%s, exit %s): %v, stderr: %s", e.Command, kind, code, e.Err, e.Stderr)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+func (c *CommandBackend) Deliver(fromAddress, toAddress string, msg Message) error {
+	return c.run(fromAddress, []string{toAddress}, msg)
+}
+
+// DeliverAll runs the command once for all recipients when its arguments
+// take {recipients}, and returns errors.ErrUnsupported otherwise.
+func (c *CommandBackend) DeliverAll(fromAddress string, recipients []string, msg Message) error {
+	for _, arg := range c.Args {
+		if arg == "{recipients}" {
+			return c.run(fromAddress, recipients, msg)
+		}
+	}
+	return errors.ErrUnsupported
+}
+
+// run runs the command once for the given recipients. The per-recipient
+// variables describe the first of them.
+func (c *CommandBackend) run(fromAddress string, recipients []string, msg Message) error {
+	if len(c.Args) == 0 {
+		return fmt.Errorf("command backend has no command configured")
+	}
+
+	vars := envelopeVars(fromAddress, recipients[0], msg)
+	replacer := strings.NewReplacer(
+		"{sender}", vars["SENDER"],
+		"{recipient}", vars["RECIPIENT"],
+		"{local}", vars["LOCAL"],
+		"{domain}", vars["DOMAIN"],
+		"{subject}", vars["SUBJECT"],
+	)
+	var args []string
+	for _, arg := range c.Args {
+		if arg == "{recipients}" {
+			args = append(args, recipients...)
+			continue
+		}
+		args = append(args, replacer.Replace(arg))
+	}
+
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	setProcessGroup(cmd)
+	// Don't wait forever on pipes held open by orphaned grandchildren
+	cmd.WaitDelay = 5 * time.Second
+	// Stream the message into stdin; closing stops the writer if the command exits early
+	stdin := messageReader(msg)
+	defer stdin.Close()
+	cmd.Stdin = stdin
+	cmd.Env = append(os.Environ(), c.Env...)
+	for name, value := range vars {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	cmdErr := &CommandError{
+		Command:  args[0],
+		ExitCode: -1,
+		Stderr:   strings.TrimSpace(stderr.String()),
+		Err:      err,
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		cmdErr.Err = fmt.Errorf("timed out after %s", c.Timeout)
+		cmdErr.Temporary = true
+	case errors.As(err, &exitErr) && exitErr.ExitCode() >= 0:
+		cmdErr.ExitCode = exitErr.ExitCode()
+		cmdErr.Temporary = c.TemporaryExitCodes[cmdErr.ExitCode]
+	default:
+		// Killed by a signal, or failed to start at all
+		cmdErr.Temporary = true
+	}
+	return commandDeliveryError(cmdErr)
+}
+
+// envelopeVars returns the envelope variables for a delivery, keyed by the
+// environment variable names exported to the command.
+func envelopeVars(fromAddress, toAddress string, msg Message) map[string]string {
+	local, domain := splitAddress(toAddress)
+	vars := map[string]string{
+		"SENDER":    fromAddress,
+		"RECIPIENT": toAddress,
+		"LOCAL":     local,
+		"DOMAIN":    domain,
+		"SUBJECT":   "",
+	}
+
+	if header, err := messageHeader(msg); err == nil {
+		subject := header.Get("Subject")
+		dec := new(mime.WordDecoder)
+		if decoded, err := dec.DecodeHeader(subject); err == nil {
+			subject = decoded
+		}
+		// Control characters have no business in argv or the environment
+		vars["SUBJECT"] = strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f {
+				return -1
+			}
+			return r
+		}, subject)
+	}
+	return vars
+}
+
+// splitArgs splits a command line at unquoted whitespace, so arguments can
+// contain spaces when quoted. Single and double quotes keep everything up to
+// the closing quote, and a backslash outside single quotes escapes the next
+// character. Nothing else is interpreted; there is no shell.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg, escaped := false, false
+	var quote rune
+	for _, r := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inArg = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// parseExitCodeMap parses "75:temp,67:perm" into exit code classifications,
+// starting from the sysexits defaults.
+func parseExitCodeMap(value string) (map[int]bool, error) {
+	codes := defaultTemporaryExitCodes()
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		codeStr, kind, ok := strings.Cut(entry, ":")
+		code, err := strconv.Atoi(codeStr)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid exit code mapping %q", entry)
+		}
+		switch kind {
+		case "temp", "temporary":
+			codes[code] = true
+		case "perm", "permanent":
+			codes[code] = false
+		default:
+			return nil, fmt.Errorf("invalid exit code mapping %q (expected temp or perm)", entry)
+		}
+	}
+	return codes, nil
+}
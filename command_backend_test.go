@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendmailUsesEnvelopeRecipients(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "argv")
+	backend := NewSendmailBackend("./mock-sendmail.sh", 10*time.Second)
+	backend.Env = []string{"MOCK_SENDMAIL_LOG=" + logPath}
+
+	var payload WebhookPayload
+	body := `{"from":{"text":"a@example.com"},"cc":{"value":[{"address":"cc@example.com"}],"text":"cc@example.com"},"subject":"hi","text":"hello"}`
+	if err := decodePayload(strings.NewReader(body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := buildMessage(&payload, messageContext{
+		FromAddress: "sender@example.com",
+		ToAddress:   "rcpt@example.com",
+		Bcc:         []string{"archive@example.com"},
+		Hostname:    "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := map[string]bool{}
+	if err := deliverEnvelope(backend, nil, &payload, msg.Envelope.From, msg.Envelope.To, done, msg); err != nil {
+		t.Fatalf("deliverEnvelope: %v", err)
+	}
+	if !done["rcpt@example.com"] || !done["archive@example.com"] {
+		t.Errorf("done = %v, want both envelope recipients", done)
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want := "-i -f sender@example.com -- rcpt@example.com archive@example.com"
+	if len(runs) != 1 || runs[0] != want {
+		t.Errorf("sendmail ran with %q, want one run with %q", runs, want)
+	}
+}
+
+func TestWebhookCommandFailureStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   int
+	}{
+		{"EX_TEMPFAIL", "cat >/dev/null; exit 75", http.StatusServiceUnavailable},
+		{"EX_NOUSER", "cat >/dev/null; exit 67", http.StatusUnprocessableEntity},
+		{"timeout", "sleep 10", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &CommandBackend{
+				Args:               []string{"/bin/sh", "-c", tt.script},
+				Timeout:            500 * time.Millisecond,
+				TemporaryExitCodes: defaultTemporaryExitCodes(),
+			}
+			start := time.Now()
+			w := postWebhook(webhookConfig{Backend: backend}, testWebhookBody)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("request took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestCommandVariables(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	backend := &CommandBackend{
+		Args: []string{"sh", "-c", `cat >/dev/null; printf '%s\n' "$@" "$SENDER" "$RECIPIENT" "$LOCAL" "$DOMAIN" "$SUBJECT" >"$OUT"`,
+			"sh", "{sender}", "{recipient}", "{local}", "{domain}", "{subject}", "to={local}@{domain}"},
+		Env: []string{"OUT=" + out},
+	}
+	msg := bytesMessage("Subject: =?utf-8?q?caf=C3=A9_*_$HOME?=\r\n\r\nhello\r\n")
+	if err := backend.Deliver("sender@example.com", "Rcpt@Example.COM", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	want := []string{
+		// Arguments, each substituted in place
+		"sender@example.com", "Rcpt@Example.COM", "Rcpt", "example.com", "café * $HOME", "to=Rcpt@example.com",
+		// Environment
+		"sender@example.com", "Rcpt@Example.COM", "Rcpt", "example.com", "café * $HOME",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("command saw %q, want %q", got, want)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"  /usr/bin/lda  -d {local} ", []string{"/usr/bin/lda", "-d", "{local}"}},
+		{`deliver -m 'Old Mail' -s "a \"b\" c"`, []string{"deliver", "-m", "Old Mail", "-s", `a "b" c`}},
+		{`one\ arg '' x`, []string{"one arg", "", "x"}},
+		{`'it''s' '\n'`, []string{"its", `\n`}},
+	}
+	for _, tt := range tests {
+		got, err := splitArgs(tt.line)
+		if err != nil || strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("splitArgs(%q) = %q, %v; want %q", tt.line, got, err, tt.want)
+		}
+	}
+	for _, line := range []string{`a 'b`, `a "b`, `a\`} {
+		if got, err := splitArgs(line); err == nil {
+			t.Errorf("splitArgs(%q) = %q, want an error", line, got)
+		}
+	}
+}
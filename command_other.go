@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op where process groups are unavailable; the
+// default cancellation still kills the command itself.
+func setProcessGroup(cmd *exec.Cmd) {}
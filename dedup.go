@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DedupStore remembers recently delivered webhooks so a retried webhook is
+// acknowledged without delivering the email a second time. Entries live in
+// an in-memory LRU bounded by maxEntries and expire after the window; with
+// a path they are also appended to a file and reloaded on startup.
+type DedupStore struct {
+	window     time.Duration
+	maxEntries int
+	path       string
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List // front is the most recently delivered
+	inflight map[string]bool
+	file     *os.File
+	appended int
+}
+
+type dedupEntry struct {
+	key       string
+	delivered time.Time
+}
+
+// NewDedupStore creates a store, loading previous entries from path if set
+func NewDedupStore(window time.Duration, maxEntries int, path string) (*DedupStore, error) {
+	if maxEntries <= 0 {
+		maxEntries = 10000
+	}
+	d := &DedupStore{
+		window:     window,
+		maxEntries: maxEntries,
+		path:       path,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		inflight:   make(map[string]bool),
+	}
+	if path == "" {
+		return d, nil
+	}
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	// Start from a compact file so it only holds live entries
+	if err := d.compact(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// dedupKey identifies a webhook: the Message-ID and recipient when the
+// payload carries one, otherwise the SHA-256 hash of the raw body.
+func dedupKey(messageID, toAddress string, bodyHash []byte) string {
+	if messageID = strings.TrimSpace(messageID); messageID != "" {
+		return "mid:" + messageID + "|" + strings.ToLower(toAddress)
+	}
+	return "sha256:" + hex.EncodeToString(bodyHash)
+}
+
+// Begin marks key as being delivered. It reports whether the key was
+// already delivered within the window, or is currently being delivered by
+// another request; in either case the caller must not deliver.
+func (d *DedupStore) Begin(key string) (duplicate, inProgress bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.entries[key]; ok {
+		if time.Since(el.Value.(*dedupEntry).delivered) <= d.window {
+			return true, false
+		}
+		d.order.Remove(el)
+		delete(d.entries, key)
+	}
+	if d.inflight[key] {
+		return false, true
+	}
+	d.inflight[key] = true
+	return false, false
+}
+
+// Finish ends a delivery started with Begin, recording it if it succeeded
+func (d *DedupStore) Finish(key string, delivered bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.inflight, key)
+	if !delivered {
+		return
+	}
+
+	now := time.Now()
+	d.add(key, now)
+
+	if d.file != nil {
+		if _, err := fmt.Fprintf(d.file, "%d %s\n", now.UnixNano(), key); err != nil {
+			log.Printf("Warning: failed to persist dedup entry: %v", err)
+		}
+		d.appended++
+		if d.appended > 2*d.maxEntries {
+			if err := d.compact(); err != nil {
+				log.Printf("Warning: failed to compact dedup file: %v", err)
+			}
+		}
+	}
+}
+
+// add inserts an entry and evicts the oldest ones beyond maxEntries
+func (d *DedupStore) add(key string, delivered time.Time) {
+	if el, ok := d.entries[key]; ok {
+		el.Value.(*dedupEntry).delivered = delivered
+		d.order.MoveToFront(el)
+	} else {
+		d.entries[key] = d.order.PushFront(&dedupEntry{key: key, delivered: delivered})
+	}
+	for d.maxEntries > 0 && d.order.Len() > d.maxEntries {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.entries, oldest.Value.(*dedupEntry).key)
+	}
+}
+
+// load reads "unixnano key" lines from the persistence file
+func (d *DedupStore) load() error {
+	f, err := os.Open(d.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open dedup file: %v", err)
+	}
+	defer f.Close()
+
+	cutoff := time.Now().Add(-d.window)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		stamp, key, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		nanos, err := strconv.ParseInt(stamp, 10, 64)
+		if err != nil {
+			continue
+		}
+		if delivered := time.Unix(0, nanos); delivered.After(cutoff) {
+			d.add(key, delivered)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the persistence file with only the live entries and
+// reopens it for appending.
+func (d *DedupStore) compact() error {
+	tmpPath := d.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create dedup file: %v", err)
+	}
+
+	w := bufio.NewWriter(tmp)
+	cutoff := time.Now().Add(-d.window)
+	// Oldest first, so reloading preserves the LRU order
+	for el := d.order.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*dedupEntry)
+		if e.delivered.After(cutoff) {
+			fmt.Fprintf(w, "%d %s\n", e.delivered.UnixNano(), e.key)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write dedup file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write dedup file: %v", err)
+	}
+	if err := os.Rename(tmpPath, d.path); err != nil {
+		return fmt.Errorf("failed to replace dedup file: %v", err)
+	}
+
+	if d.file != nil {
+		d.file.Close()
+	}
+	d.file, err = os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		d.file = nil
+		return fmt.Errorf("failed to open dedup file: %v", err)
+	}
+	d.appended = 0
+	return nil
+}
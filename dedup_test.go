@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// finish records keys as delivered
+func finish(d *DedupStore, keys ...string) {
+	for _, key := range keys {
+		d.Begin(key)
+		d.Finish(key, true)
+	}
+}
+
+func isDuplicate(d *DedupStore, key string) bool {
+	duplicate, _ := d.Begin(key)
+	if !duplicate {
+		d.Finish(key, false)
+	}
+	return duplicate
+}
+
+func TestWebhookDeduplication(t *testing.T) {
+	dedup, err := NewDedupStore(time.Hour, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &recordingBackend{}
+	cfg := webhookConfig{Backend: backend, Dedup: dedup}
+
+	for i := 0; i < 2; i++ {
+		if w := postWebhook(cfg, testWebhookBody); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d", i, w.Code)
+		}
+	}
+	if got := backend.deliveries(); len(got) != 1 {
+		t.Errorf("delivered %d times, want the retry acknowledged without delivery", len(got))
+	}
+}
+
+func TestDedupExpiry(t *testing.T) {
+	d, err := NewDedupStore(50*time.Millisecond, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	finish(d, "a")
+	if !isDuplicate(d, "a") {
+		t.Fatal("key not remembered within the window")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if isDuplicate(d, "a") {
+		t.Error("key still remembered after the window")
+	}
+}
+
+func TestDedupEvictsLeastRecent(t *testing.T) {
+	d, err := NewDedupStore(time.Hour, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	finish(d, "a", "b", "c")
+	if isDuplicate(d, "a") {
+		t.Error("oldest key not evicted")
+	}
+	if !isDuplicate(d, "b") || !isDuplicate(d, "c") {
+		t.Error("recent keys evicted")
+	}
+}
+
+func TestDedupPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	d, err := NewDedupStore(time.Hour, 2, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough entries to trigger compaction (more than twice maxEntries appended)
+	finish(d, "a", "b", "c", "d", "e")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("file has %d lines after compaction, want 2:\n%s", lines, data)
+	}
+
+	reloaded, err := NewDedupStore(time.Hour, 2, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isDuplicate(reloaded, "d") || !isDuplicate(reloaded, "e") {
+		t.Error("live keys lost across restart")
+	}
+	if isDuplicate(reloaded, "a") {
+		t.Error("evicted key came back after restart")
+	}
+}
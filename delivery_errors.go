@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// DeliveryError describes why a backend could not deliver a message, with
+// enough detail for the webhook caller to decide whether to retry.
+type DeliveryError struct {
+	// Code is the SMTP/LMTP reply code, e.g. 550 (0 when not applicable)
+	Code int
+	// EnhancedCode is the RFC 3463 status code, e.g. "5.1.1" (optional)
+	EnhancedCode string
+	// Temporary is true when the same delivery may succeed later
+	Temporary bool
+	Err       error
+}
+
+func (e *DeliveryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// enhancedCodePattern matches an RFC 3463 status code at the start of a reply text
+var enhancedCodePattern = regexp.MustCompile(`^([245])\.(\d{1,3})\.(\d{1,3})\b`)
+
+// sysexitEnhancedCodes maps sysexits to RFC 3463 codes the way Postfix does
+var sysexitEnhancedCodes = map[int]string{
+	exUsage:       "5.3.0",
+	exDataErr:     "5.6.0",
+	exNoInput:     "5.3.0",
+	exNoUser:      "5.1.1",
+	exNoHost:      "5.1.2",
+	exUnavailable: "5.3.0",
+	exSoftware:    "5.3.0",
+	exOSErr:       "4.3.0",
+	exOSFile:      "5.3.0",
+	exCantCreat:   "5.2.0",
+	exIOErr:       "4.3.0",
+	exTempFail:    "4.3.0",
+	exProtocol:    "5.5.0",
+	exNoPerm:      "5.7.0",
+	exConfig:      "5.3.5",
+}
+
+// replyDeliveryError classifies an error from an SMTP or LMTP conversation.
+// Server replies are classified by their code; anything else (connection
+// resets, timeouts) is temporary.
+func replyDeliveryError(err error) *DeliveryError {
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) {
+		return &DeliveryError{Temporary: true, Err: err}
+	}
+
+	derr := &DeliveryError{
+		Code:      tpErr.Code,
+		Temporary: tpErr.Code < 500,
+		Err:       err,
+	}
+	if m := enhancedCodePattern.FindString(tpErr.Msg); m != "" && m[0] == strconv.Itoa(tpErr.Code)[0] {
+		derr.EnhancedCode = m
+	}
+	return derr
+}
+
+// commandDeliveryError classifies a failed command by its sysexits code
+func commandDeliveryError(cmdErr *CommandError) *DeliveryError {
+	enhanced := sysexitEnhancedCodes[cmdErr.ExitCode]
+	if enhanced == "" || (enhanced[0] == '4') != cmdErr.Temporary {
+		enhanced = "5.3.0"
+		if cmdErr.Temporary {
+			enhanced = "4.3.0"
+		}
+	}
+	return &DeliveryError{EnhancedCode: enhanced, Temporary: cmdErr.Temporary, Err: cmdErr}
+}
+
+// classifyDeliveryError turns any backend error into a DeliveryError, or
+// returns nil when the error carries no usable classification.
+func classifyDeliveryError(err error) *DeliveryError {
+	var derr *DeliveryError
+	if errors.As(err, &derr) {
+		return derr
+	}
+
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		return commandDeliveryError(cmdErr)
+	}
+
+	var lmtpErr *LMTPDeliveryError
+	if errors.As(err, &lmtpErr) && len(lmtpErr.Failed) > 0 {
+		// Retry if any recipient might still succeed
+		first := lmtpErr.Failed[0]
+		derr := replyDeliveryError(&textproto.Error{Code: first.Code, Msg: first.Message})
+		for _, f := range lmtpErr.Failed {
+			if f.Code < 500 {
+				derr.Temporary = true
+			}
+		}
+		derr.Err = err
+		return derr
+	}
+
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return &DeliveryError{Temporary: statusErr.temporary(), Err: err}
+	}
+
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return replyDeliveryError(err)
+	}
+
+	// Connection failures and timeouts are worth retrying. *net.OpError,
+	// *url.Error and DNS errors all implement net.Error.
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &DeliveryError{Temporary: true, Err: err}
+	}
+
+	// So are local file system errors, such as a full disk or a mailbox
+	// directory with the wrong permissions
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	if errors.As(err, &pathErr) || errors.As(err, &linkErr) {
+		return &DeliveryError{EnhancedCode: "4.3.0", Temporary: true, Err: err}
+	}
+
+	return nil
+}
+
+// deliveredRecipients returns the recipients a failed multi-recipient
+// delivery did reach
+func deliveredRecipients(err error) []string {
+	var lmtpErr *LMTPDeliveryError
+	if errors.As(err, &lmtpErr) {
+		return lmtpErr.Delivered
+	}
+	return nil
+}
+
+// deliveryErrorStatus maps a delivery failure to the HTTP response for the
+// webhook caller: 503 for temporary failures it should retry, 422 for
+// permanent ones it should not, and 500 when the failure is unclassified.
+func deliveryErrorStatus(err error) (int, string) {
+	derr := classifyDeliveryError(err)
+	if derr == nil {
+		return http.StatusInternalServerError, "Error processing email"
+	}
+	if derr.Temporary {
+		return http.StatusServiceUnavailable, "Temporary delivery failure, retry later"
+	}
+	return http.StatusUnprocessableEntity, "Permanent delivery failure"
+}
+
+// deliveryErrorResponse is the JSON body returned when delivery fails
+type deliveryErrorResponse struct {
+	Status       string `json:"status"`
+	Message      string `json:"message"`
+	Temporary    bool   `json:"temporary"`
+	Code         int    `json:"code,omitempty"`
+	EnhancedCode string `json:"enhanced_code,omitempty"`
+}
+
+// writeDeliveryError writes the HTTP status and JSON error body for a failed delivery
+func writeDeliveryError(w http.ResponseWriter, err error) {
+	status, message := deliveryErrorStatus(err)
+	resp := deliveryErrorResponse{Status: "error", Message: message}
+	if derr := classifyDeliveryError(err); derr != nil {
+		resp.Temporary = derr.Temporary
+		resp.Code = derr.Code
+		resp.EnhancedCode = derr.EnhancedCode
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "60")
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		fmt.Fprintf(w, `{"status":"error","message":"Error processing email"}`)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyDeliveryError(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"reply 450", &textproto.Error{Code: 450, Msg: "4.2.1 busy"}, http.StatusServiceUnavailable},
+		{"reply 550", &textproto.Error{Code: 550, Msg: "5.1.1 unknown"}, http.StatusUnprocessableEntity},
+		{"connection refused", fmt.Errorf("failed to connect: %w", refused), http.StatusServiceUnavailable},
+		{"HTTP timeout", &url.Error{Op: "Post", URL: "http://x", Err: refused}, http.StatusServiceUnavailable},
+		{"connection closed", fmt.Errorf("greeting failed: %w", io.EOF), http.StatusServiceUnavailable},
+		{"file system", fmt.Errorf("failed to open mbox: %w", &fs.PathError{Op: "open", Path: "/x", Err: syscall.ENOSPC}), http.StatusServiceUnavailable},
+		{"IMAP NO", imapDeliveryError(&imapStatusError{Command: "APPEND", Status: "NO", Text: "[TRYCREATE] no such mailbox"}), http.StatusUnprocessableEntity},
+		{"IMAP over quota", imapDeliveryError(&imapStatusError{Command: "APPEND", Status: "NO", Text: "[OVERQUOTA] quota exceeded"}), http.StatusServiceUnavailable},
+		{"unclassified", errors.New("something odd"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := deliveryErrorStatus(tt.err); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLMTPConnectionFailureIsTemporary(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	err = (&LMTPBackend{Address: addr}).Deliver("a@example.com", "b@example.com", bytesMessage("\r\n"))
+	var derr *DeliveryError
+	if !errors.As(err, &derr) || !derr.Temporary {
+		t.Errorf("err = %#v, want a temporary *DeliveryError", err)
+	}
+}
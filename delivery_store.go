@@ -0,0 +1,400 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery statuses reported by the status API
+const (
+	StatusQueued     = "queued"
+	StatusDelivering = "delivering"
+	StatusRetrying   = "retrying"
+	StatusDelivered  = "delivered"
+	StatusFailed     = "failed"
+)
+
+// DeliveryRecord is what the status API knows about one processed webhook
+type DeliveryRecord struct {
+	ID        string `json:"id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Subject   string `json:"subject"`
+	MessageID string `json:"message_id,omitempty"`
+	Backend   string `json:"backend"`
+	Status    string `json:"status"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+	// Pending lists the envelope recipients still to deliver to when the
+	// message reached some of them
+	Pending   []string  `json:"pending,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// trackingIDPattern matches IDs from newTrackingID, which keeps them safe as file names
+var trackingIDPattern = regexp.MustCompile(`^[0-9a-f]{24}$`)
+
+// DeliveryStore keeps delivery records for the retention period. With a
+// directory each record is also written to <dir>/<id>.json so it survives
+// restarts, and permanently failed messages are kept alongside as dead
+// letters (<id>.eml, plus <id>.payload with the original webhook body).
+// Dead letters and their records outlive the retention period until they
+// are replayed or purged. All methods are safe to call on a nil store, which records nothing.
+type DeliveryStore struct {
+	dir       string
+	retention time.Duration
+
+	mu      sync.Mutex
+	records map[string]*DeliveryRecord
+}
+
+// NewDeliveryStore creates a store, loading unexpired records from dir if set
+func NewDeliveryStore(dir string, retention time.Duration) (*DeliveryStore, error) {
+	s := &DeliveryStore{
+		dir:       dir,
+		retention: retention,
+		records:   make(map[string]*DeliveryRecord),
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create delivery store: %v", err)
+		}
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	go func() {
+		for range time.Tick(time.Hour) {
+			s.prune()
+		}
+	}()
+	return s, nil
+}
+
+// Create starts tracking a delivery
+func (s *DeliveryStore) Create(rec *DeliveryRecord) {
+	if s == nil {
+		return
+	}
+	now := time.Now().UTC()
+	rec.CreatedAt, rec.UpdatedAt = now, now
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[rec.ID] = rec
+	s.save(rec)
+}
+
+// RecordAttempt updates a delivery after an attempt. willRetry marks a
+// failed attempt that will be tried again.
+func (s *DeliveryStore) RecordAttempt(id string, err error, willRetry bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.records[id]
+	if !ok {
+		return
+	}
+	rec.Attempts++
+	rec.UpdatedAt = time.Now().UTC()
+	switch {
+	case err == nil:
+		rec.Status = StatusDelivered
+	case willRetry:
+		rec.Status = StatusRetrying
+		rec.LastError = err.Error()
+	default:
+		rec.Status = StatusFailed
+		rec.LastError = err.Error()
+	}
+	s.save(rec)
+}
+
+// SetStatus changes the status of a delivery without counting an attempt
+func (s *DeliveryStore) SetStatus(id, status string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rec, ok := s.records[id]; ok {
+		rec.Status = status
+		rec.UpdatedAt = time.Now().UTC()
+		s.save(rec)
+	}
+}
+
+// SetPending records the envelope recipients a delivery has yet to reach
+func (s *DeliveryStore) SetPending(id string, pending []string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rec, ok := s.records[id]; ok {
+		rec.Pending = pending
+		rec.UpdatedAt = time.Now().UTC()
+		s.save(rec)
+	}
+}
+
+// Get returns a copy of a delivery record
+func (s *DeliveryStore) Get(id string) (DeliveryRecord, bool) {
+	if s == nil {
+		return DeliveryRecord{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.records[id]
+	if !ok {
+		return DeliveryRecord{}, false
+	}
+	return *rec, true
+}
+
+// SaveDeadLetter keeps the message of a permanently failed delivery so it can
+// be replayed later. It needs a store directory; without one it does nothing.
+func (s *DeliveryStore) SaveDeadLetter(id string, msg Message, rawBody []byte) {
+	if s == nil || s.dir == "" {
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, id+".eml"), msg); err != nil {
+		log.Printf("Warning: failed to save dead letter %s: %v", id, err)
+		return
+	}
+	if rawBody != nil {
+		if err := writeFileAtomic(filepath.Join(s.dir, id+".payload"), bytesMessage(rawBody)); err != nil {
+			log.Printf("Warning: failed to save dead letter payload %s: %v", id, err)
+		}
+	}
+}
+
+// LoadDeadLetter returns the stored message, which is read from disk as it
+// is delivered, and the original webhook body (nil if it wasn't kept) of a
+// failed delivery.
+func (s *DeliveryStore) LoadDeadLetter(id string) (msg Message, rawBody []byte, err error) {
+	if s == nil || s.dir == "" || !trackingIDPattern.MatchString(id) {
+		return nil, nil, fmt.Errorf("no stored message for %s", id)
+	}
+	path := filepath.Join(s.dir, id+".eml")
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil, fmt.Errorf("no stored message for %s: %v", id, err)
+	}
+	rawBody, err = os.ReadFile(filepath.Join(s.dir, id+".payload"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("failed to read payload for %s: %v", id, err)
+	}
+	return fileMessage(path), rawBody, nil
+}
+
+// hasDeadLetter reports whether a message is stored for a delivery
+func (s *DeliveryStore) hasDeadLetter(id string) bool {
+	if s.dir == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(s.dir, id+".eml"))
+	return err == nil
+}
+
+// DeleteDeadLetter removes the stored message of a delivery, keeping its record
+func (s *DeliveryStore) DeleteDeadLetter(id string) {
+	if s == nil || s.dir == "" || !trackingIDPattern.MatchString(id) {
+		return
+	}
+	os.Remove(filepath.Join(s.dir, id+".eml"))
+	os.Remove(filepath.Join(s.dir, id+".payload"))
+}
+
+// DeliveryFilter selects delivery records; empty fields match everything
+type DeliveryFilter struct {
+	Status string
+	From   string
+	To     string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f DeliveryFilter) matches(rec *DeliveryRecord) bool {
+	if f.Status != "" && rec.Status != f.Status {
+		return false
+	}
+	if f.From != "" && !strings.EqualFold(rec.From, f.From) {
+		return false
+	}
+	if f.To != "" && !strings.EqualFold(rec.To, f.To) {
+		return false
+	}
+	if !f.Since.IsZero() && rec.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && rec.CreatedAt.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// List returns copies of the records matching filter, oldest first
+func (s *DeliveryStore) List(filter DeliveryFilter) []DeliveryRecord {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []DeliveryRecord
+	for _, rec := range s.records {
+		if filter.matches(rec) {
+			result = append(result, *rec)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result
+}
+
+// Delete removes a record together with any stored dead letter
+func (s *DeliveryStore) Delete(id string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(id)
+}
+
+// remove drops a record from memory and disk; the caller holds s.mu
+func (s *DeliveryStore) remove(id string) {
+	delete(s.records, id)
+	if s.dir != "" {
+		for _, ext := range []string{".json", ".eml", ".payload"} {
+			os.Remove(filepath.Join(s.dir, id+ext))
+		}
+	}
+}
+
+// save writes a record to disk; the caller holds s.mu
+func (s *DeliveryStore) save(rec *DeliveryRecord) {
+	if s.dir == "" {
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Warning: failed to encode delivery record %s: %v", rec.ID, err)
+		return
+	}
+	path := filepath.Join(s.dir, rec.ID+".json")
+	if err := writeFileAtomic(path, bytesMessage(data)); err != nil {
+		log.Printf("Warning: failed to save delivery record %s: %v", rec.ID, err)
+	}
+}
+
+// load reads unexpired records, and those with a dead letter, from the
+// store directory
+func (s *DeliveryStore) load() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("failed to list delivery store: %v", err)
+	}
+	cutoff := time.Now().Add(-s.retention)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var rec DeliveryRecord
+		if err := json.Unmarshal(data, &rec); err != nil || !trackingIDPattern.MatchString(rec.ID) {
+			log.Printf("Warning: skipping unreadable delivery record %s", path)
+			continue
+		}
+		if rec.UpdatedAt.Before(cutoff) && !s.hasDeadLetter(rec.ID) {
+			s.remove(rec.ID)
+			continue
+		}
+		s.records[rec.ID] = &rec
+	}
+	return nil
+}
+
+// prune drops records last updated before the retention period. Records
+// with a dead letter stay until it is replayed or purged.
+func (s *DeliveryStore) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-s.retention)
+	for id, rec := range s.records {
+		if rec.UpdatedAt.Before(cutoff) && !s.hasDeadLetter(id) {
+			s.remove(id)
+		}
+	}
+}
+
+// writeFileAtomic writes src to a temporary file and renames it into place
+func writeFileAtomic(path string, src io.WriterTo) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = src.WriteTo(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// makeDeliveryStatusHandler serves GET <prefix>/deliveries/{id}, authenticated
+// with "Authorization: Bearer <apiKey>".
+func makeDeliveryStatusHandler(store *DeliveryStore, apiKey, prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || apiKey == "" || subtle.ConstantTimeCompare([]byte(token), []byte(apiKey)) != 1 {
+			log.Printf("Delivery status authentication failed from %s", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, prefix)
+		if !trackingIDPattern.MatchString(id) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		rec, ok := store.Get(id)
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rec)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testTrackingID = "0123456789abcdef01234567"
+
+func TestDeliveryStatusHandler(t *testing.T) {
+	store, err := NewDeliveryStore("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Create(&DeliveryRecord{ID: testTrackingID, From: "sender@example.com", To: "rcpt@example.com",
+		Subject: "hi", Backend: "smtp", Status: StatusQueued})
+	attemptErr := &DeliveryError{Code: 451, Temporary: true, Err: fmt.Errorf("try later")}
+	store.RecordAttempt(testTrackingID, attemptErr, true)
+	handler := makeDeliveryStatusHandler(store, "secret", "/deliveries/")
+
+	tests := []struct {
+		name string
+		path string
+		auth string
+		want int
+	}{
+		{"no token", "/deliveries/" + testTrackingID, "", http.StatusUnauthorized},
+		{"wrong token", "/deliveries/" + testTrackingID, "Bearer wrong", http.StatusUnauthorized},
+		{"bare key", "/deliveries/" + testTrackingID, "secret", http.StatusUnauthorized},
+		{"malformed ID", "/deliveries/../dedup", "Bearer secret", http.StatusNotFound},
+		{"unknown ID", "/deliveries/ffffffffffffffffffffffff", "Bearer secret", http.StatusNotFound},
+		{"found", "/deliveries/" + testTrackingID, "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			handler(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var rec map[string]any
+			if err := json.NewDecoder(w.Body).Decode(&rec); err != nil {
+				t.Fatal(err)
+			}
+			for field, want := range map[string]any{
+				"id":         testTrackingID,
+				"from":       "sender@example.com",
+				"to":         "rcpt@example.com",
+				"backend":    "smtp",
+				"status":     StatusRetrying,
+				"attempts":   float64(1),
+				"last_error": attemptErr.Error(),
+			} {
+				if rec[field] != want {
+					t.Errorf("%s = %v, want %v", field, rec[field], want)
+				}
+			}
+		})
+	}
+}
+
+func TestDeliveryStorePrune(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDeliveryStore(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const freshID = "fedcba9876543210fedcba98"
+	store.Create(&DeliveryRecord{ID: testTrackingID, Status: StatusDelivered})
+	store.Create(&DeliveryRecord{ID: freshID, Status: StatusDelivered})
+	store.mu.Lock()
+	store.records[testTrackingID].UpdatedAt = time.Now().Add(-2 * time.Hour)
+	store.mu.Unlock()
+
+	store.prune()
+	if _, ok := store.Get(testTrackingID); ok {
+		t.Error("expired record is still served")
+	}
+	if _, err := os.Stat(filepath.Join(dir, testTrackingID+".json")); !os.IsNotExist(err) {
+		t.Errorf("expired record file: %v", err)
+	}
+	if _, ok := store.Get(freshID); !ok {
+		t.Error("record within retention was pruned")
+	}
+}
+
+func TestDeliveryStorePruneKeepsDeadLetters(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDeliveryStore(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Create(&DeliveryRecord{ID: testTrackingID, Status: StatusFailed})
+	store.SaveDeadLetter(testTrackingID, bytesMessage("Subject: hi\r\n\r\nhello\r\n"), []byte(testWebhookBody))
+	store.mu.Lock()
+	store.records[testTrackingID].UpdatedAt = time.Now().Add(-2 * time.Hour)
+	store.save(store.records[testTrackingID])
+	store.mu.Unlock()
+
+	store.prune()
+	if _, ok := store.Get(testTrackingID); !ok {
+		t.Error("record with a dead letter was pruned")
+	}
+	for _, ext := range []string{".json", ".eml", ".payload"} {
+		if _, err := os.Stat(filepath.Join(dir, testTrackingID+ext)); err != nil {
+			t.Errorf("%s: %v", ext, err)
+		}
+	}
+
+	// Nor is it dropped when loaded after a restart
+	reopened, err := NewDeliveryStore(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Get(testTrackingID); !ok {
+		t.Error("record with a dead letter was not loaded")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"sync"
+	"testing"
+)
+
+// fakeServer accepts connections on a local port and runs serve for each
+// one, closing them all when the test ends. It returns the address to dial and a function
+// reporting how many connections were accepted.
+func fakeServer(t *testing.T, serve func(text *textproto.Conn)) (addr string, conns func() int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var open []net.Conn
+	t.Cleanup(func() {
+		// Clients may keep connections open, e.g. in a pool
+		ln.Close()
+		mu.Lock()
+		for _, conn := range open {
+			conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			open = append(open, conn)
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				text := textproto.NewConn(conn)
+				defer text.Close()
+				serve(text)
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(open)
+	}
+}
@@ -4,15 +4,22 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"hash"
 )
 
 // computeHMAC generates an HMAC SHA-256 signature for the given data
 func computeHMAC(data []byte, secret string) []byte {
-	h := hmac.New(sha256.New, []byte(secret))
+	h := newHMAC(secret)
 	h.Write(data)
 	return h.Sum(nil)
 }
 
+// newHMAC returns an HMAC SHA-256 hash for computing a signature while
+// the data is streamed through it
+func newHMAC(secret string) hash.Hash {
+	return hmac.New(sha256.New, []byte(secret))
+}
+
 // verifySignature performs constant-time comparison of two signatures.
 // providedHex is the hex-encoded signature from the header.
 // expectedBytes is the raw byte slice of the expected HMAC.
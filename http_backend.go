@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTP backend body formats
+const (
+	HTTPFormatJSON       = "json"       // the original webhook JSON, unchanged
+	HTTPFormatNormalized = "normalized" // a flattened JSON model of the email
+	HTTPFormatRFC822     = "rfc822"     // the rebuilt RFC822 message
+)
+
+// HTTPBackend turns received email into an HTTP POST to another service
+type HTTPBackend struct {
+	URL    string
+	Format string
+	// SigningKey signs the outgoing body in X-Webhook-Signature (optional)
+	SigningKey string
+	Timeout    time.Duration
+	// MaxAttempts bounds retries of 5xx and 429 responses and timeouts
+	MaxAttempts int
+	// MaxElapsed bounds all attempts together, backoff included, e.g. to
+	// answer the webhook in time (0 means no limit)
+	MaxElapsed time.Duration
+	Client     *http.Client
+}
+
+// normalizedEmail is the JSON model posted with HTTPFormatNormalized
+type normalizedEmail struct {
+	From        string                 `json:"from"`
+	FromName    string                 `json:"from_name,omitempty"`
+	To          string                 `json:"to"`
+	Recipients  []string               `json:"recipients"`
+	Cc          []string               `json:"cc,omitempty"`
+	Subject     string                 `json:"subject"`
+	Date        string                 `json:"date"`
+	Text        string                 `json:"text,omitempty"`
+	HTML        string                 `json:"html,omitempty"`
+	Attachments []normalizedAttachment `json:"attachments"`
+}
+
+type normalizedAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+// httpStatusError is a non-2xx reply from the target service
+type httpStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP backend returned %d: %s", e.StatusCode, e.Body)
+}
+
+// temporary reports whether the target service may accept the request later
+func (e *httpStatusError) temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// DeliversOnce reports true: the target URL is the same for every recipient
+func (h *HTTPBackend) DeliversOnce() bool {
+	return true
+}
+
+// NeedsRawBody reports whether the original webhook JSON is forwarded
+func (h *HTTPBackend) NeedsRawBody() bool {
+	return h.Format == HTTPFormatJSON
+}
+
+func (h *HTTPBackend) Deliver(fromAddress, toAddress string, msg Message) error {
+	return h.DeliverPayload(nil, nil, fromAddress, toAddress, msg)
+}
+
+func (h *HTTPBackend) DeliverPayload(rawBody []byte, payload *WebhookPayload, fromAddress, toAddress string, msg Message) error {
+	var body Message
+	var contentType string
+
+	switch h.Format {
+	case HTTPFormatJSON:
+		if rawBody == nil {
+			return fmt.Errorf("HTTP backend format %q requires the webhook payload", h.Format)
+		}
+		body, contentType = bytesMessage(rawBody), "application/json"
+	case HTTPFormatNormalized:
+		if payload == nil {
+			return fmt.Errorf("HTTP backend format %q requires the webhook payload", h.Format)
+		}
+		data, err := json.Marshal(normalizeEmail(payload, fromAddress, toAddress))
+		if err != nil {
+			return fmt.Errorf("failed to encode normalized email: %v", err)
+		}
+		body, contentType = bytesMessage(data), "application/json"
+	default:
+		body, contentType = msg, "message/rfc822"
+	}
+
+	attempts := h.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	ctx := context.Background()
+	if h.MaxElapsed > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.MaxElapsed)
+		defer cancel()
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = h.post(ctx, body, contentType, fromAddress, toAddress)
+		if err == nil || !isRetryableHTTPError(err) {
+			return err
+		}
+		if attempt == attempts {
+			break
+		}
+		backoff := time.Duration(attempt*attempt) * time.Second
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			break
+		}
+		log.Printf("HTTP backend attempt %d/%d failed, retrying in %s: %v", attempt, attempts, backoff, err)
+		time.Sleep(backoff)
+	}
+	return err
+}
+
+// post sends a single request to the target URL, streaming the body. The
+// body is rendered once beforehand to learn its length and signature.
+func (h *HTTPBackend) post(ctx context.Context, body Message, contentType, fromAddress, toAddress string) error {
+	var size int64
+	var err error
+	var signature string
+	if h.SigningKey != "" {
+		mac := newHMAC(h.SigningKey)
+		size, err = body.WriteTo(mac)
+		signature = hex.EncodeToString(mac.Sum(nil))
+	} else {
+		size, err = messageSize(body)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to render request body: %v", err)
+	}
+
+	reader := messageReader(body)
+	defer reader.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %v", err)
+	}
+	req.ContentLength = size
+	req.GetBody = func() (io.ReadCloser, error) {
+		return messageReader(body), nil
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "forwardemail-webhook")
+	req.Header.Set("X-Envelope-From", fromAddress)
+	req.Header.Set("X-Envelope-To", toAddress)
+	if signature != "" {
+		req.Header.Set("X-Webhook-Signature", signature)
+	}
+
+	client := h.Client
+	if client == nil {
+		timeout := h.Timeout
+		if timeout == 0 {
+			timeout = 30 * time.Second
+		}
+		client = &http.Client{Timeout: timeout}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("HTTP backend request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &httpStatusError{StatusCode: resp.StatusCode, Body: string(snippet)}
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// isRetryableHTTPError reports whether a failed POST is worth retrying:
+// 5xx and 429 responses, timeouts and connection failures are, other
+// statuses are not.
+func isRetryableHTTPError(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.temporary()
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// normalizeEmail flattens the mailparser payload into normalizedEmail
+func normalizeEmail(payload *WebhookPayload, fromAddress, toAddress string) normalizedEmail {
+	n := normalizedEmail{
+		From:        fromAddress,
+		To:          toAddress,
+		Recipients:  payload.Recipients,
+		Subject:     payload.Subject,
+		Date:        payload.Date,
+		Text:        payload.Text,
+		HTML:        payload.HTML,
+		Attachments: []normalizedAttachment{},
+	}
+	if len(payload.From.Value) > 0 {
+		n.FromName = payload.From.Value[0].Name
+	}
+	if n.Recipients == nil {
+		n.Recipients = []string{toAddress}
+	}
+	for _, cc := range payload.Cc.Value {
+		n.Cc = append(n.Cc, cc.Address)
+	}
+	for _, att := range payload.Attachments {
+		n.Attachments = append(n.Attachments, normalizedAttachment{
+			Filename:    att.Filename,
+			ContentType: att.ContentType,
+			Size:        len(att.Content.Data),
+		})
+	}
+	return n
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPBackendPostsOncePerEnvelope(t *testing.T) {
+	var posts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		if got := r.Header.Get("X-Envelope-To"); got != "rcpt@example.com" {
+			t.Errorf("X-Envelope-To = %q", got)
+		}
+	}))
+	defer srv.Close()
+
+	backend := &HTTPBackend{URL: srv.URL, Format: HTTPFormatRFC822}
+	recipients := []string{"rcpt@example.com", "archive@example.com", "audit@example.com"}
+	done := map[string]bool{}
+	if err := deliverEnvelope(backend, nil, nil, "sender@example.com", recipients, done, bytesMessage("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if n := posts.Load(); n != 1 {
+		t.Errorf("%d posts, want 1", n)
+	}
+	if len(done) != len(recipients) {
+		t.Errorf("done = %v, want every recipient", done)
+	}
+}
+
+func TestHTTPBackendMaxElapsed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hang until the client gives up; reading the body lets the server notice
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	backend := &HTTPBackend{URL: srv.URL, Format: HTTPFormatRFC822, Timeout: time.Minute, MaxAttempts: 3, MaxElapsed: 200 * time.Millisecond}
+	start := time.Now()
+	err := backend.Deliver("sender@example.com", "rcpt@example.com", bytesMessage("\r\nhello\r\n"))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("delivery took %s, want it bounded by MaxElapsed", elapsed)
+	}
+	if status, _ := deliveryErrorStatus(err); status != http.StatusServiceUnavailable {
+		t.Errorf("err = %v (status %d), want a temporary failure", err, status)
+	}
+}
+
+func TestHTTPRetryMatchesClassification(t *testing.T) {
+	for _, code := range []int{400, 404, 413, 429, 500, 502, 503} {
+		err := &httpStatusError{StatusCode: code}
+		if retry, temporary := isRetryableHTTPError(err), classifyDeliveryError(err).Temporary; retry != temporary {
+			t.Errorf("%d: retried %v, but classified temporary %v", code, retry, temporary)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IMAPBackend places messages directly into a folder of a hosted mailbox
+// using IMAP APPEND. The logged-in connection is kept and reused across
+// deliveries.
+type IMAPBackend struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	// Folder is the mailbox messages are appended to (e.g. "INBOX")
+	Folder string
+	// Flags are set on appended messages, e.g. []string{`\Seen`}
+	Flags []string
+	// TLSMode is "tls" for implicit TLS, "starttls", or "none"
+	TLSMode    string
+	SkipVerify bool
+	Timeout    time.Duration
+
+	mu   sync.Mutex
+	conn *imapConn
+}
+
+// imapStatusError is a tagged NO or BAD reply from the server
+type imapStatusError struct {
+	Command string
+	Status  string
+	Text    string
+}
+
+func (e *imapStatusError) Error() string {
+	return fmt.Sprintf("IMAP %s failed: %s %s", e.Command, e.Status, e.Text)
+}
+
+// responseCode returns the RFC 5530 response code of the reply, such as
+// "OVERQUOTA" for "[OVERQUOTA] Quota exceeded", or "" if it has none
+func (e *imapStatusError) responseCode() string {
+	if !strings.HasPrefix(e.Text, "[") {
+		return ""
+	}
+	code, _, _ := strings.Cut(e.Text[1:], "]")
+	code, _, _ = strings.Cut(code, " ")
+	return strings.ToUpper(code)
+}
+
+// imapTemporaryCodes maps the response codes of failures that may clear up
+// on their own to RFC 3463 codes
+var imapTemporaryCodes = map[string]string{
+	"OVERQUOTA":   "4.2.2",
+	"UNAVAILABLE": "4.3.0",
+	"INUSE":       "4.3.0",
+	"LIMIT":       "4.3.0",
+	"SERVERBUG":   "4.3.0",
+}
+
+// imapDeliveryError classifies an IMAP failure. NO and BAD replies to
+// APPEND are permanent unless their response code says otherwise; anything
+// else (connection resets, timeouts, failed logins) is temporary.
+func imapDeliveryError(err error) *DeliveryError {
+	var derr *DeliveryError
+	if errors.As(err, &derr) {
+		return derr
+	}
+	var statusErr *imapStatusError
+	if !errors.As(err, &statusErr) || statusErr.Command != "APPEND" {
+		return &DeliveryError{Temporary: true, Err: err}
+	}
+	if enhanced, ok := imapTemporaryCodes[statusErr.responseCode()]; ok {
+		return &DeliveryError{EnhancedCode: enhanced, Temporary: true, Err: err}
+	}
+	return &DeliveryError{EnhancedCode: "5.3.0", Err: err}
+}
+
+func (b *IMAPBackend) Deliver(fromAddress, toAddress string, msg Message) error {
+	if err := b.appendMessage(msg); err != nil {
+		return imapDeliveryError(err)
+	}
+	return nil
+}
+
+// appendMessage appends msg to the folder, logging in first if needed
+func (b *IMAPBackend) appendMessage(msg Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// A reused connection may have been dropped by the server while idle,
+	// so a connection-level failure before the message was sent is retried
+	// once on a fresh connection.
+	for attempt := 0; ; attempt++ {
+		if b.conn == nil {
+			conn, err := b.dial()
+			if err != nil {
+				// Connection, TLS and login problems are on our side, not
+				// the message's, so they are always worth retrying
+				return &DeliveryError{Temporary: true, Err: err}
+			}
+			b.conn = conn
+		}
+
+		sent, err := b.conn.appendMessage(b.Folder, b.Flags, msg, b.timeout())
+		if err == nil {
+			return nil
+		}
+
+		var statusErr *imapStatusError
+		if errors.As(err, &statusErr) {
+			return err
+		}
+
+		b.conn.close()
+		b.conn = nil
+		// Once the literal was sent the server may have stored the message,
+		// and appending it again could leave a duplicate
+		if attempt > 0 || sent {
+			return err
+		}
+	}
+}
+
+func (b *IMAPBackend) timeout() time.Duration {
+	if b.Timeout == 0 {
+		return 60 * time.Second
+	}
+	return b.Timeout
+}
+
+// dial connects, negotiates TLS and logs in
+func (b *IMAPBackend) dial() (*imapConn, error) {
+	addr := net.JoinHostPort(b.Host, b.Port)
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: b.SkipVerify,
+		ServerName:         b.Host,
+	}
+	dialer := &net.Dialer{Timeout: b.timeout()}
+
+	var conn net.Conn
+	var err error
+	if b.TLSMode == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to IMAP server: %w", err)
+	}
+
+	c := &imapConn{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(b.timeout()))
+
+	greeting, err := c.readLine()
+	if err != nil {
+		c.conn.Close()
+		return nil, fmt.Errorf("IMAP greeting failed: %w", err)
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		c.conn.Close()
+		return nil, fmt.Errorf("unexpected IMAP greeting: %s", greeting)
+	}
+
+	if b.TLSMode == "starttls" {
+		if err := c.command("STARTTLS"); err != nil {
+			c.conn.Close()
+			return nil, fmt.Errorf("STARTTLS failed: %w", err)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("STARTTLS failed: %w", err)
+		}
+		c.conn = tlsConn
+		c.r = bufio.NewReader(tlsConn)
+	}
+
+	if !strings.HasPrefix(greeting, "* PREAUTH") {
+		if err := c.command("LOGIN %s %s", imapQuote(b.User), imapQuote(b.Password)); err != nil {
+			c.conn.Close()
+			return nil, fmt.Errorf("IMAP authentication failed: %w", err)
+		}
+	}
+
+	c.conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// imapConn is a minimal IMAP4rev1 client connection
+type imapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// appendMessage uploads a message to folder with a synchronizing literal.
+// sent reports whether the server asked for the literal, after which a
+// failure leaves it unknown whether the message was stored.
+func (c *imapConn) appendMessage(folder string, flags []string, msg Message, timeout time.Duration) (sent bool, err error) {
+	// The literal announces its length, so render the message once to measure it
+	size, err := messageSize(msg)
+	if err != nil {
+		return false, fmt.Errorf("failed to render message: %v", err)
+	}
+
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	flagList := ""
+	if len(flags) > 0 {
+		flagList = "(" + strings.Join(flags, " ") + ") "
+	}
+
+	tag := c.nextTag()
+	if _, err := fmt.Fprintf(c.conn, "%s APPEND %s %s{%d}\r\n", tag, imapQuote(folder), flagList, size); err != nil {
+		return false, err
+	}
+
+	// Wait for the continuation request before sending the literal
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return false, err
+		}
+		if strings.HasPrefix(line, "+") {
+			break
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			return false, parseTaggedStatus("APPEND", line[len(tag)+1:])
+		}
+	}
+
+	n, err := msg.WriteTo(c.conn)
+	if err != nil {
+		return true, err
+	}
+	if n != size {
+		return true, fmt.Errorf("message changed size while sending (%d of %d bytes)", n, size)
+	}
+	if _, err := c.conn.Write([]byte("\r\n")); err != nil {
+		return true, err
+	}
+
+	return true, c.waitTagged(tag, "APPEND")
+}
+
+// command sends a simple command and waits for its tagged completion
+func (c *imapConn) command(format string, args ...interface{}) error {
+	tag := c.nextTag()
+	cmd := fmt.Sprintf(format, args...)
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, cmd); err != nil {
+		return err
+	}
+	name := strings.SplitN(cmd, " ", 2)[0]
+	return c.waitTagged(tag, name)
+}
+
+// waitTagged reads lines until the tagged reply for tag, skipping untagged data
+func (c *imapConn) waitTagged(tag, name string) error {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			return parseTaggedStatus(name, line[len(tag)+1:])
+		}
+	}
+}
+
+func (c *imapConn) nextTag() string {
+	c.tag++
+	return fmt.Sprintf("A%04d", c.tag)
+}
+
+func (c *imapConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// close logs out, ignoring errors since the connection is being dropped anyway
+func (c *imapConn) close() {
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c.conn, "%s LOGOUT\r\n", c.nextTag())
+	c.conn.Close()
+}
+
+// parseTaggedStatus turns "OK ...", "NO ..." or "BAD ..." into an error value
+func parseTaggedStatus(name, rest string) error {
+	status, text, _ := strings.Cut(rest, " ")
+	if strings.EqualFold(status, "OK") {
+		return nil
+	}
+	return &imapStatusError{Command: name, Status: strings.ToUpper(status), Text: text}
+}
+
+// imapQuote encodes s as an IMAP quoted string
+func imapQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
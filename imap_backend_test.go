@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIMAP is an IMAP server that accepts one login and APPENDs. reply
+// decides the fate of the n-th APPEND (from 1, across connections): "OK",
+// a tagged NO reply such as "NO [OVERQUOTA] full", "drop" to hang up before
+// the continuation, or "drop after literal" to hang up once it has the message.
+type fakeIMAP struct {
+	reply func(n int) string
+	// loginReply answers LOGIN instead of OK when set
+	loginReply string
+
+	mu       sync.Mutex
+	logins   []string
+	appends  []string
+	messages []string
+}
+
+func (f *fakeIMAP) serve(text *textproto.Conn) {
+	text.PrintfLine("* OK fake IMAP ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		tag, cmd, _ := strings.Cut(line, " ")
+		name, args, _ := strings.Cut(cmd, " ")
+		switch strings.ToUpper(name) {
+		case "LOGIN":
+			f.mu.Lock()
+			f.logins = append(f.logins, args)
+			f.mu.Unlock()
+			if f.loginReply != "" {
+				text.PrintfLine("%s %s", tag, f.loginReply)
+				continue
+			}
+			text.PrintfLine("%s OK logged in", tag)
+		case "APPEND":
+			f.mu.Lock()
+			f.appends = append(f.appends, args)
+			n := len(f.appends)
+			f.mu.Unlock()
+
+			reply := f.reply(n)
+			switch {
+			case reply == "drop":
+				return
+			case strings.HasPrefix(reply, "NO"):
+				text.PrintfLine("%s %s", tag, reply)
+				continue
+			}
+
+			size, _ := strconv.Atoi(args[strings.LastIndex(args, "{")+1 : len(args)-1])
+			text.PrintfLine("+ ready for literal")
+			literal := make([]byte, size+2)
+			if _, err := io.ReadFull(text.R, literal); err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.messages = append(f.messages, string(literal[:size]))
+			f.mu.Unlock()
+			if reply == "drop after literal" {
+				return
+			}
+			text.PrintfLine("%s OK APPEND completed", tag)
+		case "LOGOUT":
+			text.PrintfLine("* BYE")
+			text.PrintfLine("%s OK", tag)
+			return
+		default:
+			text.PrintfLine("%s BAD unknown command", tag)
+		}
+	}
+}
+
+// counts returns how many logins, APPENDs and messages the server has seen
+func (f *fakeIMAP) counts() (logins, appends, messages int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.logins), len(f.appends), len(f.messages)
+}
+
+// newFakeIMAPBackend starts f and returns a backend logging in to it
+func newFakeIMAPBackend(t *testing.T, f *fakeIMAP) (*IMAPBackend, func() int) {
+	addr, conns := fakeServer(t, f.serve)
+	host, port, _ := net.SplitHostPort(addr)
+	return &IMAPBackend{
+		Host:     host,
+		Port:     port,
+		User:     "user",
+		Password: `pa"ss`,
+		Folder:   "INBOX",
+		Flags:    []string{`\Seen`},
+		TLSMode:  "none",
+		Timeout:  5 * time.Second,
+	}, conns
+}
+
+func TestIMAPAppend(t *testing.T) {
+	f := &fakeIMAP{reply: func(int) string { return "OK" }}
+	backend, conns := newFakeIMAPBackend(t, f)
+
+	for i := 1; i <= 2; i++ {
+		msg := bytesMessage(fmt.Sprintf("Subject: %d\r\n\r\nhello\r\n", i))
+		if err := backend.Deliver("a@example.com", "b@example.com", msg); err != nil {
+			t.Fatalf("delivery %d: %v", i, err)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.logins) != 1 || f.logins[0] != `"user" "pa\"ss"` {
+		t.Errorf("logins = %q, want one with quoted credentials", f.logins)
+	}
+	if len(f.appends) != 2 || !strings.HasPrefix(f.appends[0], `"INBOX" (\Seen) {`) {
+		t.Errorf("appends = %q", f.appends)
+	}
+	if len(f.messages) != 2 || f.messages[1] != "Subject: 2\r\n\r\nhello\r\n" {
+		t.Errorf("messages = %q", f.messages)
+	}
+	if n := conns(); n != 1 {
+		t.Errorf("%d connections, want the login reused", n)
+	}
+}
+
+func TestIMAPAppendRejected(t *testing.T) {
+	tests := []struct {
+		reply         string
+		wantTemporary bool
+	}{
+		{"NO [TRYCREATE] no such mailbox", false},
+		{"NO [OVERQUOTA] mailbox full", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reply, func(t *testing.T) {
+			f := &fakeIMAP{reply: func(int) string { return tt.reply }}
+			backend, _ := newFakeIMAPBackend(t, f)
+
+			err := backend.Deliver("a@example.com", "b@example.com", bytesMessage("\r\nhello\r\n"))
+			var derr *DeliveryError
+			if !errors.As(err, &derr) || derr.Temporary != tt.wantTemporary {
+				t.Fatalf("err = %v, want *DeliveryError with Temporary %v", err, tt.wantTemporary)
+			}
+			if _, appends, _ := f.counts(); appends != 1 {
+				t.Errorf("%d APPENDs, want a rejection not to be retried", appends)
+			}
+		})
+	}
+}
+
+func TestIMAPReconnect(t *testing.T) {
+	// The server hangs up on the second APPEND, as if the idle connection had timed out
+	f := &fakeIMAP{reply: func(n int) string {
+		if n == 2 {
+			return "drop"
+		}
+		return "OK"
+	}}
+	backend, conns := newFakeIMAPBackend(t, f)
+
+	for i := 1; i <= 2; i++ {
+		if err := backend.Deliver("a@example.com", "b@example.com", bytesMessage("\r\nhello\r\n")); err != nil {
+			t.Fatalf("delivery %d: %v", i, err)
+		}
+	}
+	logins, _, messages := f.counts()
+	if messages != 2 || logins != 2 || conns() != 2 {
+		t.Errorf("messages %d, logins %d, connections %d; want 2 each", messages, logins, conns())
+	}
+}
+
+func TestIMAPNoRetryAfterLiteral(t *testing.T) {
+	f := &fakeIMAP{reply: func(int) string { return "drop after literal" }}
+	backend, conns := newFakeIMAPBackend(t, f)
+
+	err := backend.Deliver("a@example.com", "b@example.com", bytesMessage("\r\nhello\r\n"))
+	var derr *DeliveryError
+	if !errors.As(err, &derr) || !derr.Temporary {
+		t.Fatalf("err = %v, want a temporary *DeliveryError", err)
+	}
+	if _, _, messages := f.counts(); messages != 1 || conns() != 1 {
+		t.Errorf("message sent %d times over %d connections, want once", messages, conns())
+	}
+}
+
+func TestIMAPLoginFailureIsTemporary(t *testing.T) {
+	// A wrong password must not make the sender give up on every message
+	f := &fakeIMAP{reply: func(int) string { return "OK" }, loginReply: "NO [AUTHENTICATIONFAILED] invalid credentials"}
+	backend, _ := newFakeIMAPBackend(t, f)
+
+	err := backend.Deliver("a@example.com", "b@example.com", bytesMessage("\r\nhello\r\n"))
+	var derr *DeliveryError
+	if !errors.As(err, &derr) || !derr.Temporary {
+		t.Fatalf("err = %v, want a temporary *DeliveryError", err)
+	}
+	if status, _ := deliveryErrorStatus(err); status != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", status)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// LMTPBackend delivers email straight into mailboxes over LMTP (RFC 2033),
+// e.g. to Dovecot. Address is either "host:port" for TCP or a Unix socket
+// path, optionally prefixed with "unix:".
+type LMTPBackend struct {
+	Address  string
+	Hostname string
+	Timeout  time.Duration
+}
+
+// LMTPRecipientError describes a recipient that was rejected, either at
+// RCPT TO or in its individual reply after DATA.
+type LMTPRecipientError struct {
+	Recipient string
+	Stage     string
+	Code      int
+	Message   string
+}
+
+func (e LMTPRecipientError) Error() string {
+	return fmt.Sprintf("%s: %s failed: %d %s", e.Recipient, e.Stage, e.Code, e.Message)
+}
+
+// LMTPDeliveryError is returned when one or more recipients were not
+// delivered. Delivered lists the recipients that were accepted, so partial
+// failures can be reported accurately.
+type LMTPDeliveryError struct {
+	Delivered []string
+	Failed    []LMTPRecipientError
+}
+
+func (e *LMTPDeliveryError) Error() string {
+	failures := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		failures[i] = f.Error()
+	}
+	return fmt.Sprintf("LMTP delivery failed for %d of %d recipients: %s",
+		len(e.Failed), len(e.Failed)+len(e.Delivered), strings.Join(failures, "; "))
+}
+
+func (l *LMTPBackend) Deliver(fromAddress, toAddress string, msg Message) error {
+	return l.DeliverAll(fromAddress, []string{toAddress}, msg)
+}
+
+// DeliverAll delivers one message to several recipients in a single LMTP
+// transaction, collecting the per-recipient replies. Failures that are not
+// about particular recipients are returned as a *DeliveryError.
+func (l *LMTPBackend) DeliverAll(fromAddress string, recipients []string, msg Message) error {
+	if err := checkAddresses(append([]string{fromAddress}, recipients...)...); err != nil {
+		return err
+	}
+	err := l.transaction(fromAddress, recipients, msg)
+	var lmtpErr *LMTPDeliveryError
+	if err == nil || errors.As(err, &lmtpErr) {
+		return err
+	}
+	return replyDeliveryError(err)
+}
+
+// transaction runs one LMTP session delivering msg to recipients
+func (l *LMTPBackend) transaction(fromAddress string, recipients []string, msg Message) error {
+	network, addr := l.dialTarget()
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = 60 * time.Second
+	}
+
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to LMTP server: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	text := textproto.NewConn(conn)
+	defer text.Close()
+
+	if _, _, err := text.ReadResponse(220); err != nil {
+		return fmt.Errorf("LMTP greeting failed: %w", err)
+	}
+
+	hostname := l.Hostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	if _, _, err := lmtpCmd(text, 250, "LHLO %s", hostname); err != nil {
+		return fmt.Errorf("LHLO failed: %w", err)
+	}
+
+	if _, _, err := lmtpCmd(text, 250, "MAIL FROM:<%s>", fromAddress); err != nil {
+		return fmt.Errorf("MAIL FROM failed: %w", err)
+	}
+
+	result := &LMTPDeliveryError{}
+	var accepted []string
+	for _, rcpt := range recipients {
+		if code, msg, err := lmtpCmd(text, 25, "RCPT TO:<%s>", rcpt); err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return fmt.Errorf("RCPT TO failed: %w", err)
+			}
+			result.Failed = append(result.Failed, LMTPRecipientError{
+				Recipient: rcpt, Stage: "RCPT TO", Code: code, Message: msg,
+			})
+			continue
+		}
+		accepted = append(accepted, rcpt)
+	}
+
+	if len(accepted) == 0 {
+		lmtpCmd(text, 221, "QUIT")
+		return result
+	}
+
+	if _, _, err := lmtpCmd(text, 354, "DATA"); err != nil {
+		return fmt.Errorf("DATA failed: %w", err)
+	}
+	w := text.DotWriter()
+	if _, err := msg.WriteTo(w); err != nil {
+		return fmt.Errorf("failed to write email data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close data writer: %w", err)
+	}
+
+	// LMTP sends one reply per accepted recipient, in RCPT order
+	for _, rcpt := range accepted {
+		code, msg, err := text.ReadResponse(250)
+		if err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return fmt.Errorf("failed to read LMTP reply for %s: %w", rcpt, err)
+			}
+			result.Failed = append(result.Failed, LMTPRecipientError{
+				Recipient: rcpt, Stage: "DATA", Code: code, Message: msg,
+			})
+			continue
+		}
+		result.Delivered = append(result.Delivered, rcpt)
+	}
+
+	lmtpCmd(text, 221, "QUIT")
+
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
+}
+
+// dialTarget splits Address into a network and address for net.Dial
+func (l *LMTPBackend) dialTarget() (string, string) {
+	if strings.HasPrefix(l.Address, "unix:") {
+		return "unix", strings.TrimPrefix(l.Address, "unix:")
+	}
+	if strings.HasPrefix(l.Address, "/") {
+		return "unix", l.Address
+	}
+	return "tcp", l.Address
+}
+
+// lmtpCmd sends a command and reads its reply
+func lmtpCmd(text *textproto.Conn, expectCode int, format string, args ...interface{}) (int, string, error) {
+	id, err := text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	return text.ReadResponse(expectCode)
+}
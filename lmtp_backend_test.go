@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLMTPPerRecipientReplies(t *testing.T) {
+	var received string
+	addr, conns := fakeServer(t, func(text *textproto.Conn) {
+		text.PrintfLine("220 lmtp ready")
+		var rcpts []string
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(line); {
+			case strings.HasPrefix(cmd, "LHLO"):
+				text.PrintfLine("250-lmtp\r\n250 PIPELINING")
+			case strings.HasPrefix(cmd, "MAIL FROM:"):
+				text.PrintfLine("250 2.1.0 OK")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				rcpts = append(rcpts, line[len("RCPT TO:"):])
+				text.PrintfLine("250 2.1.5 OK")
+			case cmd == "DATA":
+				text.PrintfLine("354 go ahead")
+				data, _ := text.ReadDotBytes()
+				received = string(data)
+				// One reply per accepted recipient, in order
+				for _, rcpt := range rcpts {
+					if strings.Contains(rcpt, "full") {
+						text.PrintfLine("552 5.2.2 %s mailbox full", rcpt)
+					} else {
+						text.PrintfLine("250 2.0.0 %s delivered", rcpt)
+					}
+				}
+			case cmd == "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("500 unknown command")
+			}
+		}
+	})
+
+	backend := &LMTPBackend{Address: addr, Hostname: "test", Timeout: 5 * time.Second}
+	recipients := []string{"rcpt@example.com", "full@example.com"}
+	done := map[string]bool{}
+	err := deliverEnvelope(backend, nil, nil, "sender@example.com", recipients, done, bytesMessage("Subject: hi\r\n\r\nhello\r\n"))
+
+	var lmtpErr *LMTPDeliveryError
+	if !errors.As(err, &lmtpErr) {
+		t.Fatalf("err = %v, want *LMTPDeliveryError", err)
+	}
+	if len(lmtpErr.Failed) != 1 || lmtpErr.Failed[0].Recipient != "full@example.com" ||
+		lmtpErr.Failed[0].Stage != "DATA" || lmtpErr.Failed[0].Code != 552 {
+		t.Errorf("failed = %+v", lmtpErr.Failed)
+	}
+	if !done["rcpt@example.com"] || done["full@example.com"] {
+		t.Errorf("done = %v, want only the first recipient", done)
+	}
+	if derr := classifyDeliveryError(err); derr == nil || derr.Temporary || derr.EnhancedCode != "5.2.2" {
+		t.Errorf("classified as %+v, want permanent 5.2.2", derr)
+	}
+	if n := conns(); n != 1 {
+		t.Errorf("%d LMTP sessions, want one for the whole envelope", n)
+	}
+	if !strings.Contains(received, "hello") {
+		t.Errorf("message not received: %q", received)
+	}
+}
+
+func TestLMTPRejectsCommandInjection(t *testing.T) {
+	addr, conns := fakeServer(t, func(text *textproto.Conn) {})
+	backend := &LMTPBackend{Address: addr, Timeout: 5 * time.Second}
+
+	err := backend.DeliverAll("sender@example.com", []string{"rcpt@example.com", "x@y>\r\nRCPT TO:<victim@example.com"}, bytesMessage("\r\nhello\r\n"))
+	var derr *DeliveryError
+	if !errors.As(err, &derr) || derr.Temporary {
+		t.Fatalf("err = %v, want a permanent *DeliveryError", err)
+	}
+	if n := conns(); n != 0 {
+		t.Errorf("%d LMTP sessions opened for an invalid address", n)
+	}
+}
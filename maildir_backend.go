@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maildirCounter makes filenames unique within this process
+var maildirCounter uint64
+
+// MaildirBackend drops messages directly into a Maildir without an MTA.
+// PathTemplate maps a recipient to a Maildir, e.g. "/var/mail/{domain}/{local}/Maildir".
+type MaildirBackend struct {
+	PathTemplate string
+}
+
+func (m *MaildirBackend) Deliver(fromAddress, toAddress string, msg Message) error {
+	dir, err := expandPathTemplate(m.PathTemplate, toAddress)
+	if err != nil {
+		return err
+	}
+
+	// Create the Maildir structure on demand
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return fmt.Errorf("failed to create maildir %s: %w", dir, err)
+		}
+	}
+
+	// The size is only known once the message has been written, so it is
+	// added to the name when moving the file into new/
+	name := maildirFilename()
+	tmpPath := filepath.Join(dir, "tmp", name)
+
+	// Write to tmp/ first so readers never see a partial message
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create maildir file: %w", err)
+	}
+	size, err := msg.WriteTo(f)
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write maildir file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync maildir file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close maildir file: %w", err)
+	}
+
+	newPath := filepath.Join(dir, "new", fmt.Sprintf("%s,S=%d", name, size))
+	if err := os.Rename(tmpPath, newPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to move message into maildir: %w", err)
+	}
+	// The rename is only durable once the directory entry is on disk
+	if err := syncDir(filepath.Join(dir, "new")); err != nil {
+		os.Remove(newPath)
+		return fmt.Errorf("failed to sync maildir: %w", err)
+	}
+
+	return nil
+}
+
+// maildirFilename builds a unique name in the usual "time.MusecPpidQn.host" form
+func maildirFilename() string {
+	now := time.Now()
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	// '/' and ':' are not allowed in the host part of Maildir names
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s",
+		now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddUint64(&maildirCounter, 1), host)
+}
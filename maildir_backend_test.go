@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dirWatchingMessage records the tmp/ and new/ entries of a Maildir while
+// it is being written
+type dirWatchingMessage struct {
+	dir      string
+	tmp, new []string
+}
+
+func (m *dirWatchingMessage) WriteTo(w io.Writer) (int64, error) {
+	m.tmp, m.new = readDirNames(m.dir, "tmp"), readDirNames(m.dir, "new")
+	n, err := io.WriteString(w, "Subject: hi\r\n\r\nhello\r\n")
+	return int64(n), err
+}
+
+func readDirNames(dir, sub string) []string {
+	entries, _ := os.ReadDir(filepath.Join(dir, sub))
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestMaildirDeliver(t *testing.T) {
+	root := t.TempDir()
+	backend := &MaildirBackend{PathTemplate: filepath.Join(root, "{domain}", "{local}", "Maildir")}
+	dir := filepath.Join(root, "example.com", "rcpt", "Maildir")
+	msg := &dirWatchingMessage{dir: dir}
+
+	if err := backend.Deliver("sender@example.com", "rcpt@example.com", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Written in tmp/, where new/ readers can't see it half done
+	if len(msg.tmp) != 1 || len(msg.new) != 0 {
+		t.Errorf("while writing: tmp/ = %v, new/ = %v", msg.tmp, msg.new)
+	}
+	if names := readDirNames(dir, "tmp"); len(names) != 0 {
+		t.Errorf("tmp/ after delivery = %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cur")); err != nil {
+		t.Errorf("cur/ not created: %v", err)
+	}
+
+	names := readDirNames(dir, "new")
+	if len(names) != 1 {
+		t.Fatalf("new/ = %v, want one message", names)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "new", names[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := msg.tmp[0] + fmt.Sprintf(",S=%d", len(data)); names[0] != want {
+		t.Errorf("delivered as %q, want %q", names[0], want)
+	}
+}
+
+func TestExpandPathTemplate(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string // "" means rejected
+	}{
+		{"rcpt@Example.COM", "/var/mail/example.com/rcpt"},
+		{"../etc@example.com", ""},
+		{"rcpt@..", ""},
+		{"a/b@example.com", ""},
+		{"rcpt@example.com/..", ""},
+		{`a\b@example.com`, ""},
+		{".hidden@example.com", ""},
+		{"no-domain", ""},
+	}
+	for _, tt := range tests {
+		got, err := expandPathTemplate("/var/mail/{domain}/{local}", tt.address)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q mapped to %q, want it rejected", tt.address, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q mapped to %q, %v; want %q", tt.address, got, err, tt.want)
+		}
+	}
+
+	if got, _ := expandPathTemplate("/srv/{address}", "rcpt@example.com"); !strings.HasSuffix(got, "/rcpt@example.com") {
+		t.Errorf("{address} = %q", got)
+	}
+}
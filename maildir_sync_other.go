@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// syncDir is a no-op where directories cannot be opened for syncing; the
+// rename into new/ is left to the filesystem's own ordering.
+func syncDir(dir string) error {
+	return nil
+}
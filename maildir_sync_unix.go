@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import "os"
+
+// syncDir flushes a directory's entries, such as a rename into it, to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package mailmsg
+
+import (
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateLayouts are the date formats accepted besides RFC 5322, which
+// mail.ParseDate handles. mailparser sends ISO 8601 (JSON dates); the rest
+// are what other webhook senders have been seen to use. Layouts without a
+// zone are taken as UTC.
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999 -0700",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+	time.RFC850,
+	time.ANSIC,
+	time.UnixDate,
+}
+
+// parseDate parses a date in RFC 5322, one of dateLayouts, or as a Unix
+// timestamp in seconds or, when too large for that, milliseconds
+func parseDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, false
+	}
+	if t, err := mail.ParseDate(s); err == nil {
+		return t, true
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 {
+		if n >= 1e11 {
+			return time.UnixMilli(n).UTC(), true
+		}
+		return time.Unix(n, 0).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// formatDate formats t as an RFC 5322 date
+func formatDate(t time.Time) string {
+	return t.Format(time.RFC1123Z)
+}
+
+// messageDate returns the Date header for p, and the original date when
+// that had to be rewritten. A missing or unparsable date is replaced by the
+// time the message was received, or else the current time. Whitespace and
+// control characters in the original, CR and LF included, become single
+// spaces so it cannot break out of its header.
+func messageDate(p *Payload) (date, original string) {
+	t, ok := parseDate(p.Date)
+	if !ok {
+		t = time.Now()
+		if p.Received != nil && !p.Received.Time.IsZero() {
+			t = p.Received.Time
+		}
+	}
+	date = formatDate(t)
+	original = singleLine(p.Date)
+	if original == date {
+		original = ""
+	}
+	return date, original
+}
@@ -0,0 +1,56 @@
+package mailmsg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // RFC 5322, empty when unparsable
+	}{
+		{"2022-05-25T19:26:41.000Z", "Wed, 25 May 2022 19:26:41 +0000"},
+		{"2022-05-25T21:26:41+02:00", "Wed, 25 May 2022 21:26:41 +0200"},
+		{"2022-05-25T19:26:41", "Wed, 25 May 2022 19:26:41 +0000"},
+		{"2022-05-25 19:26:41", "Wed, 25 May 2022 19:26:41 +0000"},
+		{"2022-05-25", "Wed, 25 May 2022 00:00:00 +0000"},
+		{"Wed, 25 May 2022 19:26:41 -0400", "Wed, 25 May 2022 19:26:41 -0400"},
+		{"25 May 2022 19:26 +0000", "Wed, 25 May 2022 19:26:00 +0000"},
+		{"Wed May 25 19:26:41 2022", "Wed, 25 May 2022 19:26:41 +0000"},
+		{"1653506801", "Wed, 25 May 2022 19:26:41 +0000"},
+		{"1653506801000", "Wed, 25 May 2022 19:26:41 +0000"},
+		{"", ""},
+		{"yesterday", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if tm, ok := parseDate(tt.in); ok {
+			got = formatDate(tm)
+		}
+		if got != tt.want {
+			t.Errorf("parseDate(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMessageDateFallsBackToReceived(t *testing.T) {
+	received := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	p := &Payload{Date: "not a date", Received: &Received{Time: received}}
+	date, original := messageDate(p)
+	if date != "Thu, 01 Jan 2026 12:00:00 +0000" || original != "not a date" {
+		t.Errorf("messageDate = %q, %q", date, original)
+	}
+
+	p.Date = ""
+	if date, original = messageDate(p); date != "Thu, 01 Jan 2026 12:00:00 +0000" || original != "" {
+		t.Errorf("messageDate without a date = %q, %q", date, original)
+	}
+}
+
+func TestMessageDateStripsLineBreaks(t *testing.T) {
+	p := &Payload{Date: "yesterday\r\nBcc: victim@example.com\n", Received: &Received{Time: time.Now()}}
+	if _, original := messageDate(p); original != "yesterday Bcc: victim@example.com" {
+		t.Errorf("original date = %q", original)
+	}
+}
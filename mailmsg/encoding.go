@@ -0,0 +1,211 @@
+package mailmsg
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"unicode"
+)
+
+// writeBodyPart writes a text body with CRLF line endings, in the transfer
+// encoding chosen by transferEncoding. A body in a charset other than UTF-8
+// is one the caller couldn't convert, so it is sent as base64 under its own
+// label.
+func writeBodyPart(w io.Writer, mediaType, body, charset string, opts Options) {
+	if charset == "" {
+		charset = "utf-8"
+	}
+	body = normalizeNewlines(body)
+	encoding := "base64"
+	if charset == "utf-8" {
+		encoding = transferEncoding(body, opts.Allow8Bit)
+	}
+
+	fmt.Fprintf(w, "Content-Type: %s; charset=%s\r\n", mediaType, charset)
+	fmt.Fprintf(w, "Content-Transfer-Encoding: %s\r\n", encoding)
+	fmt.Fprintf(w, "\r\n")
+
+	switch encoding {
+	case "quoted-printable":
+		qp := quotedprintable.NewWriter(w)
+		io.WriteString(qp, body)
+		qp.Close()
+	case "base64":
+		writeBase64Lines(w, []byte(body))
+	default:
+		io.WriteString(w, body)
+	}
+	fmt.Fprintf(w, "\r\n")
+}
+
+// maxLineLength is the longest line RFC 5322 allows, excluding the CRLF
+const maxLineLength = 998
+
+// transferEncoding picks the Content-Transfer-Encoding for a CRLF normalized
+// body: 7bit for ASCII with lines short enough, 8bit for other text when the
+// transport accepts it, and otherwise quoted-printable, or base64 when so
+// much of the body needs escaping that quoted-printable would bloat it.
+func transferEncoding(body string, allow8bit bool) string {
+	nonASCII, lineLength := 0, 0
+	longLines, controls := false, false
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; {
+		case c == '\n':
+			lineLength = 0
+			continue
+		case c == '\r':
+			continue
+		case c >= 0x80:
+			nonASCII++
+		case c < 0x20 && c != '\t', c == 0x7f:
+			controls = true
+		}
+		lineLength++
+		if lineLength > maxLineLength {
+			longLines = true
+		}
+	}
+
+	switch {
+	case nonASCII == 0 && !longLines && !controls:
+		return "7bit"
+	case allow8bit && !longLines && !controls:
+		return "8bit"
+	case nonASCII > len(body)/3:
+		return "base64"
+	default:
+		return "quoted-printable"
+	}
+}
+
+// normalizeNewlines turns bare LF and bare CR line endings into CRLF
+func normalizeNewlines(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s) + len(s)/32)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\r':
+			b.WriteString("\r\n")
+			if i+1 < len(s) && s[i+1] == '\n' {
+				i++
+			}
+		case '\n':
+			b.WriteString("\r\n")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// encodeHeaderText encodes non-ASCII header text as RFC 2047 encoded words,
+// unless the transport accepts UTF-8 headers
+func encodeHeaderText(s string, allowUTF8 bool) string {
+	s = singleLine(s)
+	if allowUTF8 || isASCII(s) {
+		return s
+	}
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+// encodeAddressHeader encodes non-ASCII display names in an address list
+// header. A list that doesn't parse is left as it is, since encoding it
+// whole would hide the addresses.
+func encodeAddressHeader(s string, allowUTF8 bool) string {
+	s = singleLine(s)
+	if allowUTF8 || isASCII(s) {
+		return s
+	}
+	addrs, err := mail.ParseAddressList(s)
+	if err != nil {
+		return s
+	}
+	formatted := make([]string, len(addrs))
+	for i, addr := range addrs {
+		formatted[i] = addr.String()
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// singleLine joins the fields of s around runs of whitespace and control
+// characters with single spaces, so a value from the payload cannot end its
+// header field and start another
+func singleLine(s string) string {
+	return strings.Join(strings.FieldsFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}), " ")
+}
+
+// isASCII reports whether s is entirely 7-bit
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeAttachment writes an attachment's header fields and base64 content
+func writeAttachment(w io.Writer, att *Attachment) error {
+	disposition := "attachment"
+	if att.Inline {
+		disposition = "inline"
+	}
+
+	// Write headers in a fixed order so the output is reproducible
+	fmt.Fprintf(w, "Content-Type: %s\r\n", att.ContentType)
+	fmt.Fprintf(w, "Content-Transfer-Encoding: base64\r\n")
+	fmt.Fprintf(w, "Content-Disposition: %s; filename=\"%s\"\r\n", disposition, att.Filename)
+	if att.ContentID != "" {
+		fmt.Fprintf(w, "Content-ID: <%s>\r\n", att.ContentID)
+	}
+	fmt.Fprintf(w, "\r\n")
+
+	// Write base64 encoded content (re-encode for proper line wrapping)
+	if err := writeBase64Lines(w, att.Data); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\r\n")
+	return err
+}
+
+// base64LineLength is the longest encoded line allowed by RFC 2045
+const base64LineLength = 76
+
+// writeBase64Lines writes data base64 encoded in lines of base64LineLength
+// characters separated by CRLF, without a line break after the last line.
+// Whole lines are encoded into a reusable chunk buffer, so the writer sees
+// a few large writes rather than one per byte.
+func writeBase64Lines(w io.Writer, data []byte) error {
+	const bytesPerLine = base64LineLength / 4 * 3
+	const linesPerChunk = 256
+
+	buf := make([]byte, 0, linesPerChunk*(base64LineLength+2))
+	for first := true; len(data) > 0; {
+		buf = buf[:0]
+		for i := 0; i < linesPerChunk && len(data) > 0; i++ {
+			if !first {
+				buf = append(buf, '\r', '\n')
+			}
+			first = false
+
+			n := min(bytesPerLine, len(data))
+			end := len(buf) + base64.StdEncoding.EncodedLen(n)
+			base64.StdEncoding.Encode(buf[len(buf):end], data[:n])
+			buf = buf[:end]
+			data = data[n:]
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
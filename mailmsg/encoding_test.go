@@ -0,0 +1,165 @@
+package mailmsg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteBase64Lines(t *testing.T) {
+	// Sizes around the 57 input bytes of a line and the chunk boundary
+	for _, size := range []int{0, 1, 2, 3, 56, 57, 58, 114, 115, 57 * 256, 57*256 + 1, 100000} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+
+		encoded := base64.StdEncoding.EncodeToString(data)
+		var lines []string
+		for len(encoded) > base64LineLength {
+			lines = append(lines, encoded[:base64LineLength])
+			encoded = encoded[base64LineLength:]
+		}
+		if encoded != "" {
+			lines = append(lines, encoded)
+		}
+		want := strings.Join(lines, "\r\n")
+
+		var buf bytes.Buffer
+		if err := writeBase64Lines(&buf, data); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != want {
+			t.Errorf("size %d: output differs from 76-column base64", size)
+		}
+	}
+}
+
+func TestTransferEncoding(t *testing.T) {
+	tests := []struct {
+		body      string
+		allow8bit bool
+		want      string
+	}{
+		{"plain ascii\r\n", false, "7bit"},
+		{"café\r\n", false, "quoted-printable"},
+		{"café\r\n", true, "8bit"},
+		{"日本語のテキスト", false, "base64"},
+		{strings.Repeat("x", maxLineLength), false, "7bit"},
+		{strings.Repeat("x", maxLineLength+1), true, "quoted-printable"},
+		{"nul\x00byte", true, "quoted-printable"},
+	}
+	for _, tt := range tests {
+		if got := transferEncoding(tt.body, tt.allow8bit); got != tt.want {
+			t.Errorf("transferEncoding(%.20q, %v) = %s, want %s", tt.body, tt.allow8bit, got, tt.want)
+		}
+	}
+
+	if got := normalizeNewlines("a\nb\rc\r\nd"); got != "a\r\nb\r\nc\r\nd" {
+		t.Errorf("normalizeNewlines = %q", got)
+	}
+}
+
+// benchmarkPayload returns a payload with a text body and one random
+// attachment of size bytes
+func benchmarkPayload(size int) *Payload {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	payload := goldenPayload()
+	payload.Subject = "Large attachment"
+	payload.Text = "See attached."
+	payload.Attachments = []Attachment{{
+		Filename:    "data.bin",
+		ContentType: "application/octet-stream",
+		Data:        data,
+	}}
+	return &payload
+}
+
+// BenchmarkMessageLargeAttachment compares streaming a message into the
+// destination writer with rendering it into a buffer first, as deliveries
+// used to. peak-heap-MB is the highest heap growth seen while writing, on
+// top of the payload itself.
+func BenchmarkMessageLargeAttachment(b *testing.B) {
+	for _, size := range []int{1 << 20, 25 << 20} {
+		msg, err := Build(benchmarkPayload(size))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("stream/%dMB", size>>20), func(b *testing.B) {
+			benchmarkPeakHeap(b, func() {
+				msg.WriteTo(io.Discard)
+			})
+		})
+		b.Run(fmt.Sprintf("buffered/%dMB", size>>20), func(b *testing.B) {
+			benchmarkPeakHeap(b, func() {
+				var buf bytes.Buffer
+				msg.WriteTo(&buf)
+				io.Discard.Write(buf.Bytes())
+			})
+		})
+	}
+}
+
+// benchmarkPeakHeap runs fn b.N times while sampling the heap, and reports
+// the peak above the starting point
+func benchmarkPeakHeap(b *testing.B, fn func()) {
+	b.ReportAllocs()
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	base := stats.HeapAlloc
+
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var stats runtime.MemStats
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > peak {
+				peak = stats.HeapAlloc
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fn()
+	}
+	b.StopTimer()
+	close(done)
+	<-sampled
+
+	growth := 0.0
+	if peak > base {
+		growth = float64(peak-base) / (1 << 20)
+	}
+	b.ReportMetric(growth, "peak-heap-MB")
+}
+
+func BenchmarkWriteAttachment(b *testing.B) {
+	for _, size := range []int{64 << 10, 1 << 20, 25 << 20} {
+		att := &benchmarkPayload(size).Attachments[0]
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				writeAttachment(io.Discard, att)
+			}
+		})
+	}
+}
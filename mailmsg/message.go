@@ -0,0 +1,419 @@
+// Package mailmsg builds RFC 5322 messages with MIME bodies from the parts
+// of a received email: headers, text and HTML bodies, and attachments.
+package mailmsg
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Payload is what a message is built from
+type Payload struct {
+	// EnvelopeFrom and EnvelopeTo are used for delivery and not written
+	// into the message, so blind copies are recipients only listed here
+	EnvelopeFrom string
+	EnvelopeTo   []string
+
+	From    string // From header, e.g. "Sender <sender@example.com>"
+	To      string // To header
+	Cc      string // Cc header, left out when empty
+	Subject string
+	// Date may be in any format parseDate understands and is rewritten as
+	// an RFC 5322 date, keeping the original in X-Original-Date. Without a
+	// usable date the Received time, or else the time of Build, is used.
+	Date string
+	// MessageID is kept, with angle brackets added if missing; Build
+	// generates one when it is empty or not of the form <left@right>
+	MessageID string
+
+	// Hostname names this host in the Received header and generated
+	// Message-IDs (default "localhost")
+	Hostname string
+	// Received describes the hop that brought the message here (optional)
+	Received *Received
+	// OriginalTo is written as X-Original-To when set
+	OriginalTo string
+	// DeliveredTo adds a Delivered-To header to copies made by ForRecipient
+	DeliveredTo bool
+	// RequestID is written as X-Webhook-Request-Id when set
+	RequestID string
+
+	Text string
+	HTML string
+	// Charsets of Text and HTML; empty means UTF-8. A body in any other
+	// charset is sent as base64 under that label.
+	TextCharset string
+	HTMLCharset string
+
+	Attachments []Attachment
+}
+
+// Attachment is a file attached to the message. Inline attachments with a
+// ContentID are grouped with the HTML body, which refers to them as cid:.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string // without angle brackets
+	Inline      bool
+	Data        []byte
+}
+
+// Received is the hop written to the Received header
+type Received struct {
+	FromIP string // the client's address
+	ID     string
+	Time   time.Time
+}
+
+// Envelope is the sender and recipients a message is delivered with
+type Envelope struct {
+	From string
+	To   []string
+}
+
+// Options describe what the transport accepts beyond 7-bit ASCII
+type Options struct {
+	// Allow8Bit permits 8bit bodies (8BITMIME)
+	Allow8Bit bool
+	// AllowUTF8Headers permits raw UTF-8 in headers (SMTPUTF8)
+	AllowUTF8Headers bool
+}
+
+// Message is a built message. The body is rendered while it is written, so
+// attachments are encoded straight into the destination rather than into an
+// intermediate buffer. WriteTo writes the same bytes every time.
+type Message struct {
+	Envelope Envelope
+
+	payload      *Payload
+	messageID    string
+	date         string
+	originalDate string
+	root         *entity
+	opts         Options
+	// recipient is the one envelope recipient this copy is for, if known
+	recipient string
+}
+
+// Builder builds messages. The zero value uses random boundaries.
+type Builder struct {
+	// NewBoundary generates MIME boundary candidates; nil means random ones
+	NewBoundary func() string
+}
+
+// Build builds a message from p with random boundaries
+func Build(p *Payload) (*Message, error) {
+	return Builder{}.Build(p)
+}
+
+// Build lays out the MIME structure of p and chooses its boundaries. The
+// payload must not change until the message has been written for the last
+// time.
+func (b Builder) Build(p *Payload) (*Message, error) {
+	newBoundary := b.NewBoundary
+	if newBoundary == nil {
+		newBoundary = generateBoundary
+	}
+	boundaries, err := chooseBoundaries(p, newBoundary)
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{
+		Envelope:  Envelope{From: p.EnvelopeFrom, To: p.EnvelopeTo},
+		payload:   p,
+		messageID: messageID(p),
+		root:      layout(p, boundaries),
+	}
+	m.date, m.originalDate = messageDate(p)
+	if len(p.EnvelopeTo) == 1 {
+		m.recipient = p.EnvelopeTo[0]
+	}
+	return m, nil
+}
+
+// MessageID returns the Message-ID header of the message
+func (m *Message) MessageID() string {
+	return m.messageID
+}
+
+// WithOptions returns a copy of m rendered for a transport accepting opts
+func (m *Message) WithOptions(opts Options) *Message {
+	if m.opts == opts {
+		return m
+	}
+	copied := *m
+	copied.opts = opts
+	return &copied
+}
+
+// ForRecipient returns a copy of m for delivery to one envelope recipient,
+// which its trace headers then name
+func (m *Message) ForRecipient(rcpt string) *Message {
+	if m.recipient == rcpt {
+		return m
+	}
+	copied := *m
+	copied.recipient = rcpt
+	return &copied
+}
+
+func (m *Message) WriteTo(dst io.Writer) (int64, error) {
+	cw := &countingWriter{w: dst}
+	bw := bufio.NewWriterSize(cw, 32*1024)
+	m.writeHeader(bw)
+	fmt.Fprintf(bw, "MIME-Version: 1.0\r\n")
+	m.root.write(bw, m.opts)
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// writeHeader writes the message header fields before the MIME ones, trace
+// fields first. Errors writing to w are left for the caller to collect from
+// its writer.
+func (m *Message) writeHeader(w io.Writer) {
+	p, utf8Headers := m.payload, m.opts.AllowUTF8Headers
+	if p.OriginalTo != "" {
+		fmt.Fprintf(w, "X-Original-To: %s\r\n", singleLine(p.OriginalTo))
+	}
+	if p.DeliveredTo && m.recipient != "" {
+		fmt.Fprintf(w, "Delivered-To: %s\r\n", singleLine(m.recipient))
+	}
+	if p.Received != nil {
+		m.writeReceived(w)
+	}
+
+	fmt.Fprintf(w, "From: %s\r\n", encodeAddressHeader(p.From, utf8Headers))
+	fmt.Fprintf(w, "To: %s\r\n", encodeAddressHeader(p.To, utf8Headers))
+	if p.Cc != "" {
+		fmt.Fprintf(w, "Cc: %s\r\n", encodeAddressHeader(p.Cc, utf8Headers))
+	}
+	fmt.Fprintf(w, "Subject: %s\r\n", encodeHeaderText(p.Subject, utf8Headers))
+	fmt.Fprintf(w, "Date: %s\r\n", m.date)
+	if m.originalDate != "" {
+		fmt.Fprintf(w, "X-Original-Date: %s\r\n", encodeHeaderText(m.originalDate, utf8Headers))
+	}
+	fmt.Fprintf(w, "Message-ID: %s\r\n", m.messageID)
+	fmt.Fprintf(w, "X-Forwarded-By: ForwardEmail Webhook\r\n")
+	if p.RequestID != "" {
+		fmt.Fprintf(w, "X-Webhook-Request-Id: %s\r\n", p.RequestID)
+	}
+}
+
+// writeReceived writes the Received header for the webhook hop, folded the
+// way MTAs usually do:
+//
+//	Received: from [203.0.113.5]
+//		by mx.example.com with HTTP id 4f2a...
+//		for <rcpt@example.com>; Thu, 01 Jan 2026 00:00:00 +0000
+func (m *Message) writeReceived(w io.Writer) {
+	r := m.payload.Received
+	from := "unknown"
+	if ip := net.ParseIP(r.FromIP); ip != nil {
+		if ip.To4() != nil {
+			from = "[" + ip.String() + "]"
+		} else {
+			from = "[IPv6:" + ip.String() + "]"
+		}
+	}
+	fmt.Fprintf(w, "Received: from %s\r\n\tby %s with HTTP", from, m.payload.hostname())
+	if r.ID != "" {
+		fmt.Fprintf(w, " id %s", r.ID)
+	}
+	if m.recipient != "" {
+		fmt.Fprintf(w, "\r\n\tfor <%s>", singleLine(m.recipient))
+	}
+	fmt.Fprintf(w, "; %s\r\n", r.Time.Format(time.RFC1123Z))
+}
+
+// hostname returns the name this host goes by in header fields
+func (p *Payload) hostname() string {
+	if p.Hostname == "" {
+		return "localhost"
+	}
+	return p.Hostname
+}
+
+// entity is a MIME entity: a multipart with children, an attachment, or a
+// text body
+type entity struct {
+	mediaType string
+	// multipart
+	boundary string
+	params   string // extra Content-Type parameters
+	children []*entity
+	// leaves
+	attachment *Attachment
+	body       string
+	charset    string
+}
+
+// layout arranges the parts of p. Text and HTML are alternatives, the HTML
+// is related to the inline attachments it refers to, and other attachments
+// are mixed in after the body:
+//
+//	multipart/mixed
+//	  multipart/alternative
+//	    text/plain
+//	    multipart/related
+//	      text/html
+//	      inline attachments
+//	  attachments
+//
+// Each multipart is left out when it would have a single child.
+func layout(p *Payload, boundaries [3]string) *entity {
+	var inline, attached []*entity
+	for i := range p.Attachments {
+		att := &p.Attachments[i]
+		if att.Inline && att.ContentID != "" && p.HTML != "" {
+			inline = append(inline, &entity{attachment: att})
+		} else {
+			attached = append(attached, &entity{attachment: att})
+		}
+	}
+
+	var body *entity
+	if p.HTML != "" {
+		body = &entity{mediaType: "text/html", body: p.HTML, charset: p.HTMLCharset}
+		if len(inline) > 0 {
+			body = &entity{
+				mediaType: "multipart/related",
+				boundary:  boundaries[2],
+				params:    `; type="text/html"`,
+				children:  append([]*entity{body}, inline...),
+			}
+		}
+	}
+	if p.Text != "" || (body == nil && len(attached) == 0) {
+		text := &entity{mediaType: "text/plain", body: p.Text, charset: p.TextCharset}
+		if body == nil {
+			body = text
+		} else {
+			body = &entity{
+				mediaType: "multipart/alternative",
+				boundary:  boundaries[1],
+				children:  []*entity{text, body},
+			}
+		}
+	}
+
+	if len(attached) == 0 {
+		return body
+	}
+	mixed := &entity{mediaType: "multipart/mixed", boundary: boundaries[0]}
+	if body != nil {
+		mixed.children = append(mixed.children, body)
+	}
+	mixed.children = append(mixed.children, attached...)
+	return mixed
+}
+
+// write writes the entity's header fields and body. The body of a leaf is
+// followed by a CRLF, which belongs to the enclosing delimiter.
+func (e *entity) write(w io.Writer, opts Options) {
+	switch {
+	case e.attachment != nil:
+		writeAttachment(w, e.attachment)
+	case e.boundary != "":
+		fmt.Fprintf(w, "Content-Type: %s%s; boundary=\"%s\"\r\n", e.mediaType, e.params, e.boundary)
+		fmt.Fprintf(w, "\r\n")
+		for _, child := range e.children {
+			fmt.Fprintf(w, "--%s\r\n", e.boundary)
+			child.write(w, opts)
+		}
+		fmt.Fprintf(w, "--%s--\r\n", e.boundary)
+	default:
+		writeBodyPart(w, e.mediaType, e.body, e.charset, opts)
+	}
+}
+
+// chooseBoundaries picks the boundaries for multipart/mixed, alternative and
+// related. None may occur in the text or HTML body, which can be written as
+// is, and none may be a prefix of another. Encoded parts can't contain a
+// boundary that has "=_" in it, as generated ones do.
+func chooseBoundaries(p *Payload, newBoundary func() string) ([3]string, error) {
+	const attempts = 10
+	var boundaries [3]string
+	usable := func(b string, chosen []string) bool {
+		if b == "" || strings.Contains(p.Text, b) || strings.Contains(p.HTML, b) {
+			return false
+		}
+		for _, other := range chosen {
+			if strings.HasPrefix(b, other) || strings.HasPrefix(other, b) {
+				return false
+			}
+		}
+		return true
+	}
+	for i := range boundaries {
+		for attempt := 0; attempt < attempts && boundaries[i] == ""; attempt++ {
+			if b := newBoundary(); usable(b, boundaries[:i]) {
+				boundaries[i] = b
+			}
+		}
+		if boundaries[i] == "" {
+			return boundaries, fmt.Errorf("no MIME boundary found that is absent from the message")
+		}
+	}
+	return boundaries, nil
+}
+
+// generateBoundary creates a random MIME boundary string
+func generateBoundary() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("----=_Part_%d_%d", time.Now().Unix(), time.Now().Nanosecond())
+	}
+	return "----=_Part_" + hex.EncodeToString(b)
+}
+
+// messageIDPattern matches a msg-id of printable ASCII, without spaces or
+// angle brackets, on both sides of a single "@"
+var messageIDPattern = regexp.MustCompile(`^<[!-;=?A-~]+@[!-;=?A-~]+>$`)
+
+// messageID returns the Message-ID of p, with angle brackets added if
+// missing, or a new one if it has none or an invalid one. Anything that
+// could break the header, such as CR or LF, makes it invalid.
+func messageID(p *Payload) string {
+	id := strings.TrimSpace(p.MessageID)
+	if id != "" && !strings.HasPrefix(id, "<") {
+		id = "<" + id + ">"
+	}
+	if !messageIDPattern.MatchString(id) {
+		return generateMessageID(p.hostname())
+	}
+	return id
+}
+
+// generateMessageID creates a unique Message-ID in the domain of host
+func generateMessageID(host string) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("<%d.%d@%s>", time.Now().Unix(), time.Now().Nanosecond(), host)
+	}
+	return "<" + hex.EncodeToString(b) + "@" + host + ">"
+}
+
+// countingWriter counts the bytes written and remembers the first error,
+// after which further writes are dropped.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,436 @@
+package mailmsg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// sequentialBoundaries returns a boundary generator for reproducible output
+func sequentialBoundaries() func() string {
+	n := 0
+	return func() string {
+		n++
+		return fmt.Sprintf("=_boundary_%c", 'a'+n-1)
+	}
+}
+
+// goldenAttachment is the attachment rendered in testdata/attachment.golden
+func goldenAttachment() Attachment {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return Attachment{Filename: "report.pdf", ContentType: "application/pdf", Data: data}
+}
+
+func goldenPayload() Payload {
+	return Payload{
+		EnvelopeFrom: "sender@example.com",
+		EnvelopeTo:   []string{"rcpt@example.com"},
+		From:         "Sender <sender@example.com>",
+		To:           "rcpt@example.com",
+		Subject:      "Quarterly report",
+		Date:         "Thu, 01 Jan 2026 00:00:00 +0000",
+		MessageID:    "golden@example.com",
+	}
+}
+
+func TestBuildGolden(t *testing.T) {
+	logo := Attachment{
+		Filename:    "logo.png",
+		ContentType: "image/png",
+		ContentID:   "logo@example.com",
+		Inline:      true,
+		Data:        []byte("\x89PNG\r\n\x1a\nnot really a png"),
+	}
+	text := "Hello,\nthe report is attached.\n"
+	html := `<p>Hello,</p><p>the report is attached.</p><img src="cid:logo@example.com">`
+
+	tests := []struct {
+		name    string
+		modify  func(p *Payload)
+		outline []string // media types, indented by nesting
+	}{
+		{"text_only", func(p *Payload) { p.Text = text },
+			[]string{"text/plain"}},
+		{"html_only", func(p *Payload) { p.HTML = html },
+			[]string{"text/html"}},
+		{"alternative", func(p *Payload) { p.Text, p.HTML = text, html },
+			[]string{"multipart/alternative", "  text/plain", "  text/html"}},
+		{"attachments", func(p *Payload) {
+			p.Text = text
+			p.Attachments = []Attachment{goldenAttachment(), {Filename: "notes.txt", ContentType: "text/plain", Data: []byte("notes")}}
+		}, []string{"multipart/mixed", "  text/plain", "  application/pdf", "  text/plain"}},
+		{"attachments_only", func(p *Payload) { p.Attachments = []Attachment{goldenAttachment()} },
+			[]string{"multipart/mixed", "  application/pdf"}},
+		{"alternative_attachments", func(p *Payload) {
+			p.Text, p.HTML = text, html
+			p.Attachments = []Attachment{goldenAttachment()}
+		}, []string{"multipart/mixed", "  multipart/alternative", "    text/plain", "    text/html", "  application/pdf"}},
+		{"inline", func(p *Payload) {
+			p.HTML = html
+			p.Attachments = []Attachment{logo}
+		}, []string{"multipart/related", "  text/html", "  image/png"}},
+		{"inline_alternative_attachments", func(p *Payload) {
+			p.Text, p.HTML = text, html
+			p.Attachments = []Attachment{logo, goldenAttachment()}
+		}, []string{"multipart/mixed", "  multipart/alternative", "    text/plain", "    multipart/related",
+			"      text/html", "      image/png", "  application/pdf"}},
+		{"cc_bcc", func(p *Payload) {
+			p.Text = text
+			p.Cc = "Colleague <colleague@example.com>, other@example.com"
+			p.EnvelopeTo = append(p.EnvelopeTo, "archive@example.com")
+		}, []string{"text/plain"}},
+		{"trace", func(p *Payload) {
+			p.Text = text
+			p.Hostname = "mx.example.net"
+			p.Received = &Received{FromIP: "203.0.113.5", ID: "4f2a9c", Time: time.Date(2026, 1, 1, 0, 0, 5, 0, time.UTC)}
+			p.OriginalTo = "rcpt@example.com"
+			p.DeliveredTo = true
+			p.RequestID = "4f2a9c"
+		}, []string{"text/plain"}},
+		{"iso_date", func(p *Payload) {
+			p.Text = text
+			p.Date = "2022-05-25T19:26:41.000Z"
+		}, []string{"text/plain"}},
+		{"non_ascii", func(p *Payload) {
+			p.From = "Zoë Müller <zoe@example.com>"
+			p.Subject = "Grüße aus Köln"
+			p.Text = "Schöne Grüße aus Köln, bis bald\n"
+		}, []string{"text/plain"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := goldenPayload()
+			tt.modify(&payload)
+			msg, err := Builder{NewBoundary: sequentialBoundaries()}.Build(&payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Envelope.From != payload.EnvelopeFrom || strings.Join(msg.Envelope.To, ",") != strings.Join(payload.EnvelopeTo, ",") {
+				t.Errorf("envelope = %+v", msg.Envelope)
+			}
+
+			var buf bytes.Buffer
+			if _, err := msg.WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("output differs from %s:\n%s", golden, buf.Bytes())
+			}
+
+			checkParsed(t, buf.Bytes(), &payload, tt.outline)
+		})
+	}
+}
+
+// checkParsed reads a built message back through net/mail and
+// mime/multipart and compares its headers, structure and decoded parts with
+// the payload it was built from
+func checkParsed(t *testing.T, raw []byte, payload *Payload, outline []string) {
+	t.Helper()
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dec mime.WordDecoder
+	subject, err := dec.DecodeHeader(m.Header.Get("Subject"))
+	if err != nil || subject != payload.Subject {
+		t.Errorf("Subject = %q (%v), want %q", subject, err, payload.Subject)
+	}
+	from, err := m.Header.AddressList("From")
+	want, _ := mail.ParseAddressList(payload.From)
+	if err != nil || len(from) != 1 || *from[0] != *want[0] {
+		t.Errorf("From = %v (%v), want %v", from, err, want)
+	}
+	if got := m.Header.Get("To"); got != payload.To {
+		t.Errorf("To = %q, want %q", got, payload.To)
+	}
+	if got := m.Header.Get("Message-ID"); got != "<golden@example.com>" {
+		t.Errorf("Message-ID = %q", got)
+	}
+	if got := m.Header.Get("Cc"); got != payload.Cc {
+		t.Errorf("Cc = %q, want %q", got, payload.Cc)
+	}
+	for _, rcpt := range payload.EnvelopeTo[1:] {
+		if bytes.Contains(raw, []byte(rcpt)) {
+			t.Errorf("envelope recipient %s appears in the message", rcpt)
+		}
+	}
+
+	var got []string
+	walkParts(t, m.Header.Get, m.Body, "", func(indent, mediaType string, params map[string]string, header func(string) string, body []byte) {
+		got = append(got, indent+mediaType)
+		if strings.HasPrefix(mediaType, "multipart/") {
+			return
+		}
+		var wantBody string
+		switch filename := params["filename"]; {
+		case filename == "" && mediaType == "text/plain":
+			wantBody = normalizeNewlines(payload.Text)
+		case filename == "" && mediaType == "text/html":
+			wantBody = normalizeNewlines(payload.HTML)
+		default:
+			att := findAttachment(payload, header("Content-Disposition"))
+			if att == nil {
+				t.Errorf("part %s is not one of the attachments", mediaType)
+				return
+			}
+			wantBody = string(att.Data)
+			if att.ContentID != "" && header("Content-ID") != "<"+att.ContentID+">" {
+				t.Errorf("%s: Content-ID = %q", att.Filename, header("Content-ID"))
+			}
+		}
+		if string(body) != wantBody {
+			t.Errorf("%s part = %q, want %q", mediaType, body, wantBody)
+		}
+	})
+	if strings.Join(got, "\n") != strings.Join(outline, "\n") {
+		t.Errorf("structure:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(outline, "\n"))
+	}
+}
+
+// findAttachment returns the attachment named in a Content-Disposition
+func findAttachment(payload *Payload, disposition string) *Attachment {
+	kind, params, err := mime.ParseMediaType(disposition)
+	if err != nil {
+		return nil
+	}
+	for i := range payload.Attachments {
+		att := &payload.Attachments[i]
+		if att.Filename == params["filename"] && (kind == "inline") == att.Inline {
+			return att
+		}
+	}
+	return nil
+}
+
+// walkParts calls visit for an entity and, depth first, everything nested
+// in it, with leaf bodies decoded
+func walkParts(t *testing.T, header func(string) string, body io.Reader, indent string,
+	visit func(indent, mediaType string, params map[string]string, header func(string) string, body []byte)) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(header("Content-Type"))
+	if err != nil {
+		t.Fatalf("Content-Type %q: %v", header("Content-Type"), err)
+	}
+	if _, dispParams, err := mime.ParseMediaType(header("Content-Disposition")); err == nil {
+		params["filename"] = dispParams["filename"]
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		visit(indent, mediaType, params, header, nil)
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", mediaType, err)
+			}
+			walkParts(t, part.Header.Get, part, indent+"  ", visit)
+		}
+		return
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("%s: %v", mediaType, err)
+	}
+	if indent == "" {
+		// A message that is a single part ends with a CRLF, which
+		// mime/multipart strips from parts as it belongs to the delimiter
+		data = bytes.TrimSuffix(data, []byte("\r\n"))
+	}
+	// mime/multipart decodes quoted-printable parts itself, and removes the
+	// Content-Transfer-Encoding header when it does
+	switch strings.ToLower(header("Content-Transfer-Encoding")) {
+	case "base64":
+		data, err = io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(data)))
+	case "quoted-printable":
+		data, err = io.ReadAll(quotedprintable.NewReader(bytes.NewReader(data)))
+	}
+	if err != nil {
+		t.Fatalf("%s: %v", mediaType, err)
+	}
+	visit(indent, mediaType, params, header, data)
+}
+
+func TestTraceHeaders(t *testing.T) {
+	payload := goldenPayload()
+	payload.MessageID = ""
+	payload.Hostname = "mx.example.net"
+	payload.EnvelopeTo = []string{"rcpt@example.com", "archive@example.com"}
+	payload.Received = &Received{FromIP: "2001:db8::1", Time: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	payload.DeliveredTo = true
+	msg, err := Build(&payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := msg.MessageID(); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@mx.example.net>") {
+		t.Errorf("generated Message-ID = %q", id)
+	}
+
+	header := func(msg *Message) mail.Header {
+		var buf bytes.Buffer
+		msg.WriteTo(&buf)
+		m, err := mail.ReadMessage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.Header
+	}
+	// A message for several recipients names none of them
+	h := header(msg)
+	if got := h.Get("Received"); got != "from [IPv6:2001:db8::1] by mx.example.net with HTTP; Thu, 01 Jan 2026 00:00:00 +0000" {
+		t.Errorf("Received = %q", got)
+	}
+	if got := h.Get("Delivered-To"); got != "" {
+		t.Errorf("Delivered-To = %q without a recipient", got)
+	}
+	if got := h.Get("Message-ID"); got != msg.MessageID() {
+		t.Errorf("Message-ID = %q, want %q", got, msg.MessageID())
+	}
+
+	h = header(msg.ForRecipient("archive@example.com"))
+	if got := h.Get("Delivered-To"); got != "archive@example.com" {
+		t.Errorf("Delivered-To = %q", got)
+	}
+	if got := h.Get("Received"); !strings.Contains(got, "for <archive@example.com>;") {
+		t.Errorf("Received = %q", got)
+	}
+}
+
+func TestMessageID(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // "" means a generated one
+	}{
+		{"<abc@example.com>", "<abc@example.com>"},
+		{" abc@example.com ", "<abc@example.com>"},
+		{"", ""},
+		{"no-at-sign", ""},
+		{"<a@b@c>", ""},
+		{"<a b@example.com>", ""},
+		{"<abc@example.com>\r\nBcc: victim@example.com", ""},
+		{"abc@example.com\nBcc: victim@example.com", ""},
+	}
+	for _, tt := range tests {
+		payload := goldenPayload()
+		payload.MessageID = tt.in
+		payload.Hostname = "mx.example.net"
+		msg, err := Build(&payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := msg.MessageID()
+		if tt.want != "" && got != tt.want {
+			t.Errorf("Message-ID for %q = %q, want %q", tt.in, got, tt.want)
+		}
+		if tt.want == "" && !strings.HasSuffix(got, "@mx.example.net>") {
+			t.Errorf("Message-ID for %q = %q, want a generated one", tt.in, got)
+		}
+
+		var buf bytes.Buffer
+		msg.WriteTo(&buf)
+		m, err := mail.ReadMessage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bcc := m.Header.Get("Bcc"); bcc != "" {
+			t.Errorf("Message-ID %q injected Bcc: %s", tt.in, bcc)
+		}
+	}
+}
+
+func TestWriteAttachmentGolden(t *testing.T) {
+	want, err := os.ReadFile("testdata/attachment.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	att := goldenAttachment()
+	buf.WriteString("--BOUNDARY\r\n")
+	if err := writeAttachment(&buf, &att); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("attachment part differs from golden output:\n%s", buf.Bytes())
+	}
+}
+
+func TestBoundaryAvoidsBodies(t *testing.T) {
+	candidates := []string{"=_in-text", "=_in-html", "=_mixed", "=_mixed-prefixed", "=_alternative", "=_related"}
+	next := func() string {
+		b := candidates[0]
+		candidates = candidates[1:]
+		return b
+	}
+	payload := &Payload{Text: "text --=_in-text", HTML: "<p>=_in-html</p>"}
+	boundaries, err := chooseBoundaries(payload, next)
+	if err != nil || boundaries != [3]string{"=_mixed", "=_alternative", "=_related"} {
+		t.Fatalf("boundaries = %q (%v)", boundaries, err)
+	}
+
+	same := func() string { return "=_in-text" }
+	if _, err := (Builder{NewBoundary: same}).Build(payload); err == nil {
+		t.Error("Build succeeded without a usable boundary")
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	const inject = "\r\nBcc: victim@example.com"
+	payload := goldenPayload()
+	payload.OriginalTo = "rcpt@example.com" + inject
+	payload.Cc = "cc@example.com" + inject
+	payload.Subject = "Hello" + inject
+	payload.Received = &Received{FromIP: "203.0.113.5", Time: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	payload.DeliveredTo = true
+	msg, err := Build(&payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	msg.ForRecipient("rcpt@example.com" + inject).WriteTo(&buf)
+	m, err := mail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcc := m.Header.Get("Bcc"); bcc != "" {
+		t.Errorf("injected Bcc: %s", bcc)
+	}
+	if got := m.Header.Get("Cc"); got != "cc@example.com Bcc: victim@example.com" {
+		t.Errorf("Cc = %q", got)
+	}
+	if got := m.Header.Get("Delivered-To"); got != "rcpt@example.com Bcc: victim@example.com" {
+		t.Errorf("Delivered-To = %q", got)
+	}
+}
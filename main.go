@@ -2,102 +2,215 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
+	"crypto/sha256"
 	_ "embed"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
+	"net"
 	"net/http"
-	"net/smtp"
-	"net/textproto"
 	"os"
-	"os/exec"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
+
+	"goapp/mailmsg"
 )
 
 //go:embed assets/logo.png
 var logoData []byte
 
-// Backend defines the interface for different email delivery methods
+// Backend defines the interface for different email delivery methods.
+// Backends stream the message from msg rather than receiving it in memory.
 type Backend interface {
-	Deliver(fromAddress string, toAddress string, emailData []byte) error
+	Deliver(fromAddress string, toAddress string, msg Message) error
 }
 
-// SendmailBackend delivers email using the local sendmail command
-type SendmailBackend struct {
-	Path string
+// PayloadBackend is implemented by backends that need the original webhook
+// payload in addition to the rebuilt RFC822 message.
+type PayloadBackend interface {
+	Backend
+	DeliverPayload(rawBody []byte, payload *WebhookPayload, fromAddress, toAddress string, msg Message) error
 }
 
-func (s *SendmailBackend) Deliver(fromAddress, toAddress string, emailData []byte) error {
-	cmd := exec.Command(s.Path, "-t", "-f", fromAddress)
-	cmd.Stdin = bytes.NewReader(emailData)
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("sendmail failed: %v, stderr: %s", err, stderr.String())
+// deliver hands a message to the backend, passing the payload along when the
+// backend wants it.
+func deliver(backend Backend, rawBody []byte, payload *WebhookPayload, fromAddress, toAddress string, msg Message) error {
+	if pb, ok := backend.(PayloadBackend); ok {
+		return pb.DeliverPayload(rawBody, payload, fromAddress, toAddress, msg)
 	}
-	return nil
+	return backend.Deliver(fromAddress, toAddress, msg)
 }
 
-// SMTPBackend delivers email using a remote SMTP server
-type SMTPBackend struct {
-	Host       string
-	Port       string
-	User       string
-	Password   string
-	SkipVerify bool
+// EnvelopeBackend is implemented by backends that can deliver one message
+// to several recipients in a single transaction. DeliverAll returns
+// errors.ErrUnsupported when the backend is not set up to.
+type EnvelopeBackend interface {
+	Backend
+	DeliverAll(fromAddress string, recipients []string, msg Message) error
 }
 
-func (s *SMTPBackend) Deliver(fromAddress, toAddress string, emailData []byte) error {
-	addr := fmt.Sprintf("%s:%s", s.Host, s.Port)
+// OnceBackend is implemented by backends whose target is the same whoever
+// the recipient is, like webhooks and chat channels. When DeliversOnce
+// reports true, a message is delivered once per envelope.
+type OnceBackend interface {
+	Backend
+	DeliversOnce() bool
+}
 
-	// Connect to the remote SMTP server
-	client, err := smtp.Dial(addr)
-	if err != nil {
-		return fmt.Errorf("failed to connect to SMTP server: %v", err)
+// NotifyingBackend is implemented by backends that hand the message to the
+// backend returned by Unwrap, if any, and then send a notification about it
+// with Notify.
+type NotifyingBackend interface {
+	Backend
+	Unwrap() Backend
+	Notify(payload *WebhookPayload, fromAddress, toAddress string, msg Message)
+}
+
+// RawBodyBackend is implemented by backends that may want the original
+// webhook JSON, which is otherwise not kept after decoding.
+type RawBodyBackend interface {
+	Backend
+	NeedsRawBody() bool
+}
+
+// deliverEnvelope delivers msg to each recipient not yet in done and adds
+// those that succeed to done, so a retry skips them. Backends that take the
+// whole envelope get it in one transaction; others get one delivery per
+// recipient, in order, stopping at the first failure so later recipients
+// (blind copies) never get a message the first one didn't.
+func deliverEnvelope(backend Backend, rawBody []byte, payload *WebhookPayload, fromAddress string, recipients []string, done map[string]bool, msg Message) error {
+	pending := pendingRecipients(recipients, done)
+	if len(pending) == 0 {
+		return nil
 	}
-	defer client.Quit()
 
-	// STARTTLS if supported
-	if ok, _ := client.Extension("STARTTLS"); ok {
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: s.SkipVerify,
-			ServerName:         s.Host,
+	if ob, ok := backend.(OnceBackend); ok && ob.DeliversOnce() {
+		return deliverOnce(backend, rawBody, payload, fromAddress, pending, done, msg)
+	}
+	if nb, ok := backend.(NotifyingBackend); ok && nb.Unwrap() != nil {
+		// Deliver the whole envelope, then notify once about the first recipient
+		rcpt := recipients[0]
+		wasDone := done[rcpt]
+		err := deliverEnvelope(nb.Unwrap(), rawBody, payload, fromAddress, recipients, done, msg)
+		if !wasDone && done[rcpt] {
+			nb.Notify(payload, fromAddress, rcpt, msg)
 		}
-		if err = client.StartTLS(tlsConfig); err != nil {
-			return fmt.Errorf("STARTTLS failed: %v", err)
+		return err
+	}
+
+	if eb, ok := backend.(EnvelopeBackend); ok && len(pending) > 1 {
+		err := eb.DeliverAll(fromAddress, pending, msg)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			delivered := pending
+			if err != nil {
+				delivered = deliveredRecipients(err)
+			}
+			for _, rcpt := range delivered {
+				done[rcpt] = true
+			}
+			return err
 		}
 	}
 
-	// Authentication if credentials provided
-	if s.User != "" {
-		auth := smtp.PlainAuth("", s.User, s.Password, s.Host)
-		if err = client.Auth(auth); err != nil {
-			return fmt.Errorf("SMTP authentication failed: %v", err)
+	for _, rcpt := range pending {
+		if err := deliver(backend, rawBody, payload, fromAddress, rcpt, forRecipient(msg, rcpt)); err != nil {
+			log.Printf("Delivery to %s failed: %v", rcpt, err)
+			return err
 		}
+		done[rcpt] = true
 	}
+	return nil
+}
 
-	// Email delivery
-	if err = client.Mail(fromAddress); err != nil {
-		return fmt.Errorf("MAIL FROM failed: %v", err)
+// deliverOnce delivers msg a single time, addressed to the first pending
+// recipient, and marks the whole envelope done. Webhook and chat targets are
+// the same whoever the recipient is, so more copies would be duplicates.
+func deliverOnce(backend Backend, rawBody []byte, payload *WebhookPayload, fromAddress string, pending []string, done map[string]bool, msg Message) error {
+	rcpt := pending[0]
+	if err := deliver(backend, rawBody, payload, fromAddress, rcpt, forRecipient(msg, rcpt)); err != nil {
+		return err
 	}
-	if err = client.Rcpt(toAddress); err != nil {
-		return fmt.Errorf("RCPT TO failed: %v", err)
+	for _, rcpt := range pending {
+		done[rcpt] = true
 	}
-	w, err := client.Data()
-	if err != nil {
-		return fmt.Errorf("DATA failed: %v", err)
+	return nil
+}
+
+// pendingRecipients returns the recipients not yet in done, in order
+func pendingRecipients(recipients []string, done map[string]bool) []string {
+	var pending []string
+	for _, rcpt := range recipients {
+		if !done[rcpt] {
+			pending = append(pending, rcpt)
+		}
 	}
-	if _, err = w.Write(emailData); err != nil {
-		return fmt.Errorf("failed to write email data: %v", err)
+	return pending
+}
+
+// SMTPBackend delivers email using a remote SMTP server.
+// Authenticated sessions are pooled and reused across deliveries.
+type SMTPBackend struct {
+	Host       string
+	Port       string
+	User       string
+	Password   string
+	SkipVerify bool
+
+	// PoolSize is the maximum number of idle sessions kept open (0 disables reuse)
+	PoolSize int
+	// IdleTimeout closes pooled sessions that have not been used for this long
+	IdleTimeout time.Duration
+	// MaxMessages closes a session after it has delivered this many messages (0 means unlimited)
+	MaxMessages int
+
+	// Allow8BitMIME sends 8bit bodies when the server advertises 8BITMIME
+	Allow8BitMIME bool
+	// AllowSMTPUTF8 sends raw UTF-8 headers when the server advertises SMTPUTF8
+	AllowSMTPUTF8 bool
+
+	poolOnce sync.Once
+	pool     *smtpPool
+}
+
+func (s *SMTPBackend) Deliver(fromAddress, toAddress string, msg Message) error {
+	// The pipelined path writes the commands itself, without net/smtp's checks
+	if err := checkAddresses(fromAddress, toAddress); err != nil {
+		return err
+	}
+	s.poolOnce.Do(func() {
+		s.pool = newSMTPPool(s)
+	})
+
+	conn, err := s.pool.get()
+	if err != nil {
+		// Connection, TLS and authentication problems are on our side of the
+		// relay, not the message's, so they are always worth retrying
+		return &DeliveryError{Temporary: true, Err: err}
 	}
-	if err = w.Close(); err != nil {
-		return fmt.Errorf("failed to close data writer: %v", err)
+
+	// Only rely on extensions the server has advertised on this session
+	has8BitMIME, _ := conn.client.Extension("8BITMIME")
+	hasSMTPUTF8, _ := conn.client.Extension("SMTPUTF8")
+	msg = withMIMEOptions(msg, mailmsg.Options{
+		Allow8Bit:        s.Allow8BitMIME && has8BitMIME,
+		AllowUTF8Headers: s.AllowSMTPUTF8 && hasSMTPUTF8,
+	})
+
+	if err := conn.send(fromAddress, toAddress, msg); err != nil {
+		// The session state is unknown after a failed transaction
+		conn.discard()
+		return replyDeliveryError(err)
 	}
 
+	s.pool.put(conn)
 	return nil
 }
 
@@ -107,11 +220,18 @@ type WebhookPayload struct {
 	Subject     string            `json:"subject"`
 	From        AddressGroup      `json:"from"`
 	To          AddressGroup      `json:"to"`
+	Cc          AddressGroup      `json:"cc"`
 	Recipients  []string          `json:"recipients"`
 	Text        string            `json:"text"`
 	HTML        string            `json:"html"`
+	MessageID   string            `json:"messageId"`
 	Headers     interface{}       `json:"headers"`
 	Attachments []EmailAttachment `json:"attachments"`
+
+	// Charsets of Text and HTML, set by decodePayload: "utf-8" unless a
+	// body is in a legacy charset that couldn't be converted
+	textCharset string
+	htmlCharset string
 }
 
 type AddressGroup struct {
@@ -126,17 +246,46 @@ type AddressEntry struct {
 
 // EmailAttachment represents an email attachment
 type EmailAttachment struct {
-	Filename    string            `json:"filename"`
-	ContentType string            `json:"contentType"`
-	Content     AttachmentContent `json:"content"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	// Encoding of string content: "base64" or "utf8" (guessed when empty)
+	Encoding string            `json:"encoding,omitempty"`
+	Content  AttachmentContent `json:"content"`
+
+	// Inline attachments, such as images the HTML refers to as cid:
+	ContentDisposition string `json:"contentDisposition,omitempty"`
+	CID                string `json:"cid,omitempty"`
+	ContentID          string `json:"contentId,omitempty"` // "<cid>"
+	Related            bool   `json:"related,omitempty"`
 }
 
+// contentID returns the attachment's Content-ID without angle brackets
+func (att EmailAttachment) contentID() string {
+	if att.CID != "" {
+		return att.CID
+	}
+	return strings.Trim(att.ContentID, "<>")
+}
+
+// AttachmentContent is usually a Node.js Buffer serialized as
+// {"type":"Buffer","data":[...]}, but a bare byte array or a base64 or plain
+// string are accepted too. Everything is decoded straight into bytes (see
+// payload_decode.go).
 type AttachmentContent struct {
-	Type string `json:"type"` // Should be "Buffer"
-	Data []int  `json:"data"` // Array of bytes as integers
+	Type string `json:"type"` // "Buffer" for the object form
+	Data []byte `json:"data"` // The decoded bytes
+
+	text   string // string content, until the encoding is known
+	isText bool
+	err    error // why the content could not be decoded
 }
 
 func main() {
+	// Dead-letter management subcommands, e.g. "web2mail list-failed"
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	// Get configuration from environment variables
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -147,43 +296,51 @@ func main() {
 	pathURL := os.Getenv("PATH_URL")
 	webhookKey := os.Getenv("WEBHOOK_KEY")
 
-	// Determine backend type
-	backendType := strings.ToLower(os.Getenv("BACKEND_TYPE"))
-	if backendType == "" {
-		backendType = "sendmail"
-	}
-
 	http.HandleFunc(pathURL+"/logo.png", handleLogo)
 
-	var backend Backend
+	// Trace headers on relayed messages name this host as the domain, or
+	// the system host name
+	hostname := domain
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	trace, err := parseTraceHeaders(envList("TRACE_HEADERS"))
+	if err != nil {
+		log.Fatalf("Invalid TRACE_HEADERS: %v", err)
+	}
 
-	switch backendType {
-	case "smtp":
-		host := os.Getenv("SMTP_HOST")
-		smtpPort := os.Getenv("SMTP_PORT")
-		user := os.Getenv("SMTP_USER")
-		pass := os.Getenv("SMTP_PASS")
-		skipVerifyStr := os.Getenv("SMTP_SKIP_VERIFY")
-		skipVerify := strings.ToLower(skipVerifyStr) == "true" || skipVerifyStr == "1"
-		if host == "" || smtpPort == "" {
-			log.Fatalf("SMTP_HOST and SMTP_PORT are required for SMTP backend")
-		}
-		backend = &SMTPBackend{
-			Host:       host,
-			Port:       smtpPort,
-			User:       user,
-			Password:   pass,
-			SkipVerify: skipVerify,
+	backendType, backend := configureBackend()
+
+	// Remember delivered webhooks so retries don't deliver twice
+	var dedup *DedupStore
+	if window := envDuration("DEDUP_WINDOW", 24*time.Hour); window > 0 {
+		var err error
+		dedup, err = NewDedupStore(window, envInt("DEDUP_SIZE", 10000), os.Getenv("DEDUP_FILE"))
+		if err != nil {
+			log.Fatalf("Failed to initialize deduplication store: %v", err)
 		}
-		log.Printf("SMTP backend configured: %s:%s (SkipVerify: %v)", host, smtpPort, skipVerify)
-	case "sendmail":
-		fallthrough
-	default:
-		sendmailPath := os.Getenv("SENDMAIL_PATH")
-		if sendmailPath == "" {
-			sendmailPath = "/usr/sbin/sendmail"
+		log.Printf("Webhook deduplication enabled (window: %s)", window)
+	}
+
+	// Delivery tracking for GET /deliveries/{id} and the dead-letter commands
+	apiKey := os.Getenv("API_KEY")
+	var deliveries *DeliveryStore
+	if apiKey != "" || os.Getenv("DELIVERY_STORE_DIR") != "" {
+		var err error
+		deliveries, err = openDeliveryStore()
+		if err != nil {
+			log.Fatalf("Failed to initialize delivery store: %v", err)
 		}
-		backend = &SendmailBackend{Path: sendmailPath}
+	}
+
+	// In async mode deliveries are queued and handled by a worker pool
+	var queue *DeliveryQueue
+	deliveryMode := strings.ToLower(os.Getenv("DELIVERY_MODE"))
+	if deliveryMode == "async" {
+		workers := envInt("ASYNC_WORKERS", 4)
+		queueSize := envInt("ASYNC_QUEUE_SIZE", 100)
+		queue = NewDeliveryQueue(backend, dedup, deliveries, workers, queueSize, envInt("ASYNC_MAX_ATTEMPTS", 5))
+		log.Printf("Async delivery enabled: %d workers, queue size %d", workers, queueSize)
 	}
 
 	// Log startup information
@@ -209,28 +366,330 @@ func main() {
 	// Set up routes with path prefix support
 	http.HandleFunc(pathURL+"/", handleHome)
 	http.HandleFunc(pathURL+"/health", handleHealth)
-	http.HandleFunc(pathURL+"/webhook/email", makeWebhookHandler(webhookKey, backend))
+	http.HandleFunc(pathURL+"/webhook/email", makeWebhookHandler(webhookConfig{
+		WebhookKey:  webhookKey,
+		Backend:     backend,
+		BackendType: backendType,
+		Dedup:       dedup,
+		Queue:       queue,
+		Deliveries:  deliveries,
+		MaxBodySize: int64(envInt("MAX_BODY_SIZE", 50<<20)),
+		KeepRawBody: needsRawBody(backend) || os.Getenv("DELIVERY_STORE_DIR") != "",
+		Bcc:         envList("BCC_ADDRESSES"),
+		Hostname:    hostname,
+		Trace:       trace,
+	}))
+	if apiKey != "" {
+		log.Printf("Delivery status API enabled")
+		http.HandleFunc(pathURL+"/deliveries/", makeDeliveryStatusHandler(deliveries, apiKey, pathURL+"/deliveries/"))
+	}
 
 	// Create server with timeouts
 	server := &http.Server{
 		Addr:           ":" + port,
 		Handler:        nil,
 		ReadTimeout:    30 * time.Second,
-		WriteTimeout:   30 * time.Second,
+		WriteTimeout:   serverWriteTimeout,
 		MaxHeaderBytes: 1 << 20,
 	}
 
+	// Shut down gracefully so queued deliveries are not lost. stopped is
+	// closed once in-flight requests have finished.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+		log.Printf("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Warning: requests still running at shutdown: %v", err)
+		}
+	}()
+
 	// Start server
 	log.Printf("Server listening on :%s", port)
-	if err := server.ListenAndServe(); err != nil {
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server failed to start: %v", err)
 	}
+	// ListenAndServe returns as soon as Shutdown starts; wait for the handlers
+	<-stopped
+
+	if queue != nil {
+		log.Printf("Waiting for queued deliveries")
+		queue.Close()
+	}
+}
+
+// serverWriteTimeout bounds how long a webhook request may take to answer
+const serverWriteTimeout = 30 * time.Second
+
+// deliveryTimeout is the default limit for sendmail, other commands and
+// HTTP backend requests. It stays below serverWriteTimeout so a hung
+// delivery is answered with 503 rather than a dropped connection.
+const deliveryTimeout = serverWriteTimeout - 5*time.Second
+
+// configureBackend builds the delivery backend described by the environment
+func configureBackend() (string, Backend) {
+	// Determine backend type
+	backendType := strings.ToLower(os.Getenv("BACKEND_TYPE"))
+	if backendType == "" {
+		backendType = "sendmail"
+	}
+
+	var backend Backend
+
+	switch backendType {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		smtpPort := os.Getenv("SMTP_PORT")
+		user := os.Getenv("SMTP_USER")
+		pass := os.Getenv("SMTP_PASS")
+		skipVerifyStr := os.Getenv("SMTP_SKIP_VERIFY")
+		skipVerify := strings.ToLower(skipVerifyStr) == "true" || skipVerifyStr == "1"
+		if host == "" || smtpPort == "" {
+			log.Fatalf("SMTP_HOST and SMTP_PORT are required for SMTP backend")
+		}
+		backend = &SMTPBackend{
+			Host:        host,
+			Port:        smtpPort,
+			User:        user,
+			Password:    pass,
+			SkipVerify:  skipVerify,
+			PoolSize:    envInt("SMTP_POOL_SIZE", 4),
+			IdleTimeout: envDuration("SMTP_IDLE_TIMEOUT", 60*time.Second),
+			MaxMessages: envInt("SMTP_MAX_MESSAGES", 100),
+
+			Allow8BitMIME: envBool("SMTP_8BITMIME"),
+			AllowSMTPUTF8: envBool("SMTP_SMTPUTF8"),
+		}
+		log.Printf("SMTP backend configured: %s:%s (SkipVerify: %v)", host, smtpPort, skipVerify)
+	case "lmtp":
+		addr := os.Getenv("LMTP_ADDR")
+		if addr == "" {
+			log.Fatalf("LMTP_ADDR is required for LMTP backend")
+		}
+		backend = &LMTPBackend{
+			Address:  addr,
+			Hostname: os.Getenv("LMTP_HOSTNAME"),
+			Timeout:  envDuration("LMTP_TIMEOUT", 60*time.Second),
+		}
+		log.Printf("LMTP backend configured: %s", addr)
+	case "maildir":
+		pathTemplate := os.Getenv("MAILDIR_PATH")
+		if pathTemplate == "" {
+			log.Fatalf("MAILDIR_PATH is required for Maildir backend")
+		}
+		backend = &MaildirBackend{PathTemplate: pathTemplate}
+		log.Printf("Maildir backend configured: %s", pathTemplate)
+	case "mbox":
+		pathTemplate := os.Getenv("MBOX_PATH")
+		if pathTemplate == "" {
+			log.Fatalf("MBOX_PATH is required for mbox backend")
+		}
+		backend = &MboxBackend{
+			PathTemplate: pathTemplate,
+			LockTimeout:  envDuration("MBOX_LOCK_TIMEOUT", 30*time.Second),
+		}
+		log.Printf("mbox backend configured: %s", pathTemplate)
+	case "imap":
+		host := os.Getenv("IMAP_HOST")
+		if host == "" {
+			log.Fatalf("IMAP_HOST is required for IMAP backend")
+		}
+		tlsMode := strings.ToLower(os.Getenv("IMAP_TLS"))
+		if tlsMode == "" {
+			tlsMode = "tls"
+		}
+		imapPort := os.Getenv("IMAP_PORT")
+		if imapPort == "" {
+			imapPort = "993"
+			if tlsMode != "tls" {
+				imapPort = "143"
+			}
+		}
+		folder := os.Getenv("IMAP_FOLDER")
+		if folder == "" {
+			folder = "INBOX"
+		}
+		skipVerifyStr := os.Getenv("IMAP_SKIP_VERIFY")
+		backend = &IMAPBackend{
+			Host:       host,
+			Port:       imapPort,
+			User:       os.Getenv("IMAP_USER"),
+			Password:   os.Getenv("IMAP_PASS"),
+			Folder:     folder,
+			Flags:      strings.Fields(os.Getenv("IMAP_FLAGS")),
+			TLSMode:    tlsMode,
+			SkipVerify: strings.ToLower(skipVerifyStr) == "true" || skipVerifyStr == "1",
+		}
+		log.Printf("IMAP backend configured: %s:%s folder %s (TLS: %s)", host, imapPort, folder, tlsMode)
+	case "http":
+		targetURL := os.Getenv("HTTP_BACKEND_URL")
+		if targetURL == "" {
+			log.Fatalf("HTTP_BACKEND_URL is required for HTTP backend")
+		}
+		format := strings.ToLower(os.Getenv("HTTP_BACKEND_FORMAT"))
+		switch format {
+		case "":
+			format = HTTPFormatJSON
+		case HTTPFormatJSON, HTTPFormatNormalized, HTTPFormatRFC822:
+		default:
+			log.Fatalf("Invalid HTTP_BACKEND_FORMAT: %s (expected json, normalized or rfc822)", format)
+		}
+		httpBackend := &HTTPBackend{
+			URL:         targetURL,
+			Format:      format,
+			SigningKey:  os.Getenv("HTTP_BACKEND_KEY"),
+			Timeout:     envDuration("HTTP_BACKEND_TIMEOUT", deliveryTimeout),
+			MaxAttempts: envInt("HTTP_BACKEND_ATTEMPTS", 3),
+		}
+		// Within a webhook request, answer in time and let the sender retry
+		if strings.ToLower(os.Getenv("DELIVERY_MODE")) != "async" {
+			httpBackend.MaxAttempts = envInt("HTTP_BACKEND_ATTEMPTS", 1)
+			httpBackend.MaxElapsed = deliveryTimeout
+		}
+		backend = httpBackend
+		log.Printf("HTTP backend configured: %s (format: %s)", targetURL, format)
+	case "notify":
+		// Chat notification only; configured below
+	case "command":
+		args, err := splitArgs(os.Getenv("COMMAND"))
+		if err != nil {
+			log.Fatalf("Invalid COMMAND: %v", err)
+		}
+		if len(args) == 0 {
+			log.Fatalf("COMMAND is required for command backend")
+		}
+		env, err := splitArgs(os.Getenv("COMMAND_ENV"))
+		if err != nil {
+			log.Fatalf("Invalid COMMAND_ENV: %v", err)
+		}
+		exitCodes, err := parseExitCodeMap(os.Getenv("COMMAND_EXIT_CODES"))
+		if err != nil {
+			log.Fatalf("Invalid COMMAND_EXIT_CODES: %v", err)
+		}
+		backend = &CommandBackend{
+			Args:               args,
+			Timeout:            envDuration("COMMAND_TIMEOUT", deliveryTimeout),
+			Env:                env,
+			TemporaryExitCodes: exitCodes,
+		}
+		log.Printf("Command backend configured: %s", strings.Join(args, " "))
+	case "sendmail":
+		fallthrough
+	default:
+		sendmailPath := os.Getenv("SENDMAIL_PATH")
+		if sendmailPath == "" {
+			sendmailPath = "/usr/sbin/sendmail"
+		}
+		backend = NewSendmailBackend(sendmailPath, envDuration("SENDMAIL_TIMEOUT", deliveryTimeout))
+	}
+
+	// Post chat notifications instead of, or in addition to, delivering the email
+	if notifyURL := os.Getenv("NOTIFY_URL"); notifyURL != "" {
+		platform := strings.ToLower(os.Getenv("NOTIFY_PLATFORM"))
+		if platform == "" {
+			platform = NotifySlack
+		}
+		notifier, err := NewNotifierBackend(notifyURL, platform, os.Getenv("NOTIFY_TEMPLATE"),
+			envInt("NOTIFY_LINES", 5), envDuration("NOTIFY_TIMEOUT", 10*time.Second), backend)
+		if err != nil {
+			log.Fatalf("Notification configuration error: %v", err)
+		}
+		backend = notifier
+		log.Printf("Chat notifications enabled: %s", platform)
+	} else if backendType == "notify" {
+		log.Fatalf("NOTIFY_URL is required for notify backend")
+	}
+
+	return backendType, backend
+}
+
+// needsRawBody reports whether the backend wants the original webhook JSON
+func needsRawBody(backend Backend) bool {
+	rb, ok := backend.(RawBodyBackend)
+	return ok && rb.NeedsRawBody()
+}
+
+// openDeliveryStore opens the delivery store configured by the environment
+func openDeliveryStore() (*DeliveryStore, error) {
+	return NewDeliveryStore(os.Getenv("DELIVERY_STORE_DIR"), envDuration("DELIVERY_RETENTION", 7*24*time.Hour))
+}
+
+// envBool reads a boolean environment variable, false unless "true" or "1"
+func envBool(name string) bool {
+	value := os.Getenv(name)
+	return strings.ToLower(value) == "true" || value == "1"
+}
+
+// envList reads a list of values separated by commas or whitespace
+func envList(name string) []string {
+	return strings.FieldsFunc(os.Getenv(name), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// envInt reads an integer environment variable, falling back to def when unset or invalid
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %d", name, value, def)
+		return def
+	}
+	return n
+}
+
+// envDuration reads a duration environment variable (e.g. "30s", "5m"), falling back to def
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %s", name, value, def)
+		return def
+	}
+	return d
+}
+
+// webhookConfig is the configuration of the webhook endpoint
+type webhookConfig struct {
+	WebhookKey string
+	Backend    Backend
+	// BackendType names the backend in delivery records, as in BACKEND_TYPE
+	BackendType string
+	// Dedup detects retried webhooks (nil disables)
+	Dedup *DedupStore
+	// Queue delivers asynchronously (nil delivers within the request)
+	Queue *DeliveryQueue
+	// Deliveries records delivery status for the status API (nil disables)
+	Deliveries *DeliveryStore
+	// MaxBodySize limits the webhook request body in bytes
+	MaxBodySize int64
+	// KeepRawBody retains the original JSON for backends and dead letters that use it
+	KeepRawBody bool
+	// Bcc are added to every message's envelope but not its headers
+	Bcc []string
+	// Hostname names this host in Received headers and generated Message-IDs
+	Hostname string
+	// Trace selects the optional trace headers
+	Trace traceHeaders
 }
 
 // makeWebhookHandler creates the webhook handler with configuration
-func makeWebhookHandler(webhookKey string, backend Backend) http.HandlerFunc {
+func makeWebhookHandler(cfg webhookConfig) http.HandlerFunc {
+	webhookKey, backend, dedup, queue := cfg.WebhookKey, cfg.Backend, cfg.Dedup, cfg.Queue
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Received %s request at %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		received := time.Now()
 
 		// Only accept POST requests
 		if r.Method != http.MethodPost {
@@ -239,14 +698,6 @@ func makeWebhookHandler(webhookKey string, backend Backend) http.HandlerFunc {
 			return
 		}
 
-		// Read request body first (we need it for signature verification)
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			log.Printf("Error reading request body: %v", err)
-			http.Error(w, "Error reading request body", http.StatusInternalServerError)
-			return
-		}
-
 		// Log request headers (useful for debugging signature/content-type)
 		for name, values := range r.Header {
 			for _, value := range values {
@@ -254,36 +705,69 @@ func makeWebhookHandler(webhookKey string, backend Backend) http.HandlerFunc {
 			}
 		}
 
-		// Verify webhook signature if key is configured
+		providedSignature := r.Header.Get("X-Webhook-Signature")
+		if webhookKey != "" && providedSignature == "" {
+			log.Printf("Webhook authentication failed: missing signature header")
+			http.Error(w, "Unauthorized: missing signature", http.StatusUnauthorized)
+			return
+		}
+
+		// Parse the payload while it streams in, computing the HMAC signature
+		// and body hash on the way. The raw body is only kept when something
+		// downstream needs it.
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodySize)
+		var mac hash.Hash
+		bodyHash := sha256.New()
+		sinks := []io.Writer{bodyHash}
 		if webhookKey != "" {
-			providedSignature := r.Header.Get("X-Webhook-Signature")
-			if providedSignature == "" {
-				log.Printf("Webhook authentication failed: missing signature header")
-				http.Error(w, "Unauthorized: missing signature", http.StatusUnauthorized)
-				return
-			}
+			mac = newHMAC(webhookKey)
+			sinks = append(sinks, mac)
+		}
+		var rawBody *bytes.Buffer
+		if cfg.KeepRawBody {
+			rawBody = new(bytes.Buffer)
+			sinks = append(sinks, rawBody)
+		}
+		stream := io.TeeReader(r.Body, io.MultiWriter(sinks...))
 
-			// Compute HMAC signature of the request body
-			expectedSignatureBytes := computeHMAC(body, webhookKey)
+		var payload WebhookPayload
+		parseErr := decodePayload(stream, &payload)
+		// Read any trailing bytes so the signature covers the whole body
+		_, readErr := io.Copy(io.Discard, stream)
+
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(parseErr, &maxBytesErr) || errors.As(readErr, &maxBytesErr) {
+			log.Printf("Request body exceeds the %d byte limit", cfg.MaxBodySize)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if readErr != nil {
+			log.Printf("Error reading request body: %v", readErr)
+			http.Error(w, "Error reading request body", http.StatusInternalServerError)
+			return
+		}
 
+		// Verify webhook signature if key is configured, before trusting anything parsed
+		if webhookKey != "" {
 			// Compare signatures using constant-time comparison
-			if !verifySignature(providedSignature, expectedSignatureBytes) {
+			if !verifySignature(providedSignature, mac.Sum(nil)) {
 				log.Printf("Webhook authentication failed: invalid signature")
 				http.Error(w, "Unauthorized: invalid signature", http.StatusUnauthorized)
 				return
 			}
 		}
 
-		// Parse JSON payload (body already read above for signature verification)
-
-		var payload WebhookPayload
-		if err := json.Unmarshal(body, &payload); err != nil {
-			log.Printf("Error parsing JSON payload: %v", err)
-			log.Printf("Raw body was: %s", string(body))
+		if parseErr != nil {
+			log.Printf("Error parsing JSON payload: %v", parseErr)
 			http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
 			return
 		}
 
+		var body []byte
+		if rawBody != nil {
+			body = rawBody.Bytes()
+		}
+
 		// Validate required fields
 		fromAddress := ""
 		if len(payload.From.Value) > 0 {
@@ -303,178 +787,146 @@ func makeWebhookHandler(webhookKey string, backend Backend) http.HandlerFunc {
 			http.Error(w, "Missing required fields", http.StatusBadRequest)
 			return
 		}
+		// The addresses end up in SMTP commands and trace headers
+		if err := checkAddresses(fromAddress, toAddress); err != nil {
+			log.Printf("Invalid address: %v", err)
+			http.Error(w, "Invalid address", http.StatusBadRequest)
+			return
+		}
+
+		// Refuse rather than relay a message with attachments missing or corrupted
+		if err := payload.attachmentErrors(); err != nil {
+			log.Printf("Invalid attachment content: %v", err)
+			http.Error(w, "Invalid attachment content: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		log.Printf("Processing email from %s to %s, subject: %s",
 			fromAddress, toAddress, payload.Subject)
 
-		// Create a buffer to construct the email in RFC822 format
-		var emailBuffer bytes.Buffer
-
-		// Write headers
-		fmt.Fprintf(&emailBuffer, "From: %s\r\n", payload.From.Text)
-		fmt.Fprintf(&emailBuffer, "To: %s\r\n", toAddress)
-		fmt.Fprintf(&emailBuffer, "Subject: %s\r\n", payload.Subject)
-		fmt.Fprintf(&emailBuffer, "Date: %s\r\n", payload.Date)
-		fmt.Fprintf(&emailBuffer, "X-Forwarded-By: ForwardEmail Webhook\r\n")
-
-		// Determine MIME structure
-		hasHTML := payload.HTML != ""
-		hasText := payload.Text != ""
-		hasAttachments := len(payload.Attachments) > 0
-
-		if !hasAttachments && !hasHTML {
-			// Simple plain text email
-			fmt.Fprintf(&emailBuffer, "Content-Type: text/plain; charset=utf-8\r\n")
-			fmt.Fprintf(&emailBuffer, "\r\n")
-			fmt.Fprintf(&emailBuffer, "%s\r\n", payload.Text)
-		} else {
-			// Multipart email
-			boundary := generateBoundary()
-
-			if hasAttachments {
-				fmt.Fprintf(&emailBuffer, "MIME-Version: 1.0\r\n")
-				fmt.Fprintf(&emailBuffer, "Content-Type: multipart/mixed; boundary=\"%s\"\r\n", boundary)
-				fmt.Fprintf(&emailBuffer, "\r\n")
-
-				// Write body part
-				if hasHTML && hasText {
-					// Nested multipart/alternative for text and HTML
-					altBoundary := generateBoundary()
-					fmt.Fprintf(&emailBuffer, "--%s\r\n", boundary)
-					fmt.Fprintf(&emailBuffer, "Content-Type: multipart/alternative; boundary=\"%s\"\r\n", altBoundary)
-					fmt.Fprintf(&emailBuffer, "\r\n")
-
-					writeTextPart(&emailBuffer, altBoundary, payload.Text)
-					writeHTMLPart(&emailBuffer, altBoundary, payload.HTML)
-
-					fmt.Fprintf(&emailBuffer, "--%s--\r\n", altBoundary)
-				} else if hasText {
-					fmt.Fprintf(&emailBuffer, "--%s\r\n", boundary)
-					writeTextPart(&emailBuffer, "", payload.Text)
-				} else if hasHTML {
-					fmt.Fprintf(&emailBuffer, "--%s\r\n", boundary)
-					writeHTMLPart(&emailBuffer, "", payload.HTML)
-				}
-
-				// Write attachments
-				for _, att := range payload.Attachments {
-					if err := writeAttachment(&emailBuffer, boundary, att); err != nil {
-						log.Printf("Warning: failed to write attachment %s: %v", att.Filename, err)
-					}
-				}
-
-				fmt.Fprintf(&emailBuffer, "--%s--\r\n", boundary)
-			} else {
-				// multipart/alternative for text and HTML only
-				fmt.Fprintf(&emailBuffer, "MIME-Version: 1.0\r\n")
-				fmt.Fprintf(&emailBuffer, "Content-Type: multipart/alternative; boundary=\"%s\"\r\n", boundary)
-				fmt.Fprintf(&emailBuffer, "\r\n")
-
-				if hasText {
-					writeTextPart(&emailBuffer, boundary, payload.Text)
-				}
-				if hasHTML {
-					writeHTMLPart(&emailBuffer, boundary, payload.HTML)
-				}
-
-				fmt.Fprintf(&emailBuffer, "--%s--\r\n", boundary)
+		// Skip webhooks that were already delivered (ForwardEmail retries on timeout)
+		var key string
+		delivered, queued := false, false
+		if dedup != nil {
+			key = dedupKey(payload.MessageID, toAddress, bodyHash.Sum(nil))
+			duplicate, inProgress := dedup.Begin(key)
+			if duplicate {
+				log.Printf("Duplicate webhook for %s, already delivered", key)
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprintf(w, `{"status":"success","message":"Email already delivered"}`)
+				return
+			}
+			if inProgress {
+				log.Printf("Duplicate webhook for %s, delivery still in progress", key)
+				w.Header().Set("Retry-After", "30")
+				http.Error(w, "Delivery already in progress", http.StatusServiceUnavailable)
+				return
 			}
+			defer func() {
+				// Queued jobs finish the key themselves once delivered
+				if !queued {
+					dedup.Finish(key, delivered)
+				}
+			}()
 		}
 
-		// Deliver the email using the configured backend
-		if err := backend.Deliver(fromAddress, toAddress, emailBuffer.Bytes()); err != nil {
-			log.Printf("Error delivering email: %v", err)
-			http.Error(w, "Error processing email", http.StatusInternalServerError)
+		// Track the delivery for the status API
+		id := newTrackingID()
+		w.Header().Set("X-Delivery-Id", id)
+
+		// The message is rendered from the payload as the backend consumes it
+		clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+		msg, err := buildMessage(&payload, messageContext{
+			FromAddress: fromAddress,
+			ToAddress:   toAddress,
+			Bcc:         cfg.Bcc,
+			RequestID:   id,
+			ClientIP:    clientIP,
+			Hostname:    cfg.Hostname,
+			Received:    received,
+			Trace:       cfg.Trace,
+		})
+		if err != nil {
+			log.Printf("Error building message: %v", err)
+			http.Error(w, "Error building message", http.StatusInternalServerError)
 			return
 		}
-
-		log.Printf("Email successfully delivered using %T", backend)
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"status":"success","message":"Email delivered"}`)
-	}
-}
-
-// writeTextPart writes a plain text MIME part
-func writeTextPart(w io.Writer, boundary, text string) {
-	if boundary != "" {
-		fmt.Fprintf(w, "--%s\r\n", boundary)
-	}
-	fmt.Fprintf(w, "Content-Type: text/plain; charset=utf-8\r\n")
-	fmt.Fprintf(w, "Content-Transfer-Encoding: 8bit\r\n")
-	fmt.Fprintf(w, "\r\n")
-	fmt.Fprintf(w, "%s\r\n", text)
-}
-
-// writeHTMLPart writes an HTML MIME part
-func writeHTMLPart(w io.Writer, boundary, html string) {
-	if boundary != "" {
-		fmt.Fprintf(w, "--%s\r\n", boundary)
-	}
-	fmt.Fprintf(w, "Content-Type: text/html; charset=utf-8\r\n")
-	fmt.Fprintf(w, "Content-Transfer-Encoding: 8bit\r\n")
-	fmt.Fprintf(w, "\r\n")
-	fmt.Fprintf(w, "%s\r\n", html)
-}
-
-// writeAttachment writes an attachment MIME part
-func writeAttachment(w io.Writer, boundary string, att EmailAttachment) error {
-	// Extract content bytes from the integer array
-	content := make([]byte, len(att.Content.Data))
-	for i, v := range att.Content.Data {
-		content[i] = byte(v)
-	}
-
-	fmt.Fprintf(w, "--%s\r\n", boundary)
-
-	// Create MIME headers for attachment
-	mimeHeader := make(textproto.MIMEHeader)
-	mimeHeader.Set("Content-Type", att.ContentType)
-	mimeHeader.Set("Content-Transfer-Encoding", "base64")
-	mimeHeader.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", att.Filename))
-
-	// Write headers
-	for key, values := range mimeHeader {
-		for _, value := range values {
-			fmt.Fprintf(w, "%s: %s\r\n", key, value)
+		rec := &DeliveryRecord{
+			ID:        id,
+			From:      fromAddress,
+			To:        toAddress,
+			Subject:   payload.Subject,
+			MessageID: payload.MessageID,
+			Backend:   cfg.BackendType,
+			Status:    StatusDelivering,
 		}
-	}
-	fmt.Fprintf(w, "\r\n")
 
-	// Write base64 encoded content (re-encode for proper line wrapping)
-	encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: w, lineLength: 76})
-	encoder.Write(content)
-	encoder.Close()
-	fmt.Fprintf(w, "\r\n")
-
-	return nil
-}
+		// In async mode hand the message to the workers and acknowledge right away
+		if queue != nil {
+			job := &deliveryJob{
+				ID:          id,
+				FromAddress: fromAddress,
+				ToAddress:   toAddress,
+				Recipients:  msg.Envelope.To,
+				Message:     msg,
+				RawBody:     body,
+				Payload:     &payload,
+				dedupKey:    key,
+			}
+			rec.Status = StatusQueued
+			cfg.Deliveries.Create(rec)
+			if !queue.Enqueue(job) {
+				// The sender is told to retry, so this is not a dead letter
+				cfg.Deliveries.Delete(id)
+				log.Printf("Delivery queue full, rejecting webhook")
+				w.Header().Set("Retry-After", "30")
+				http.Error(w, "Delivery queue full, retry later", http.StatusServiceUnavailable)
+				return
+			}
+			queued = true
 
-// lineWrapper wraps base64 output to 76 characters per line
-type lineWrapper struct {
-	w           io.Writer
-	lineLength  int
-	currentLine int
-}
+			log.Printf("[%s] Email queued for delivery", job.ID)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, `{"status":"accepted","message":"Email queued for delivery","id":"%s"}`, job.ID)
+			return
+		}
 
-func (lw *lineWrapper) Write(p []byte) (n int, err error) {
-	for i, b := range p {
-		if lw.currentLine >= lw.lineLength {
-			if _, err := lw.w.Write([]byte("\r\n")); err != nil {
-				return i, err
+		// Deliver the email using the configured backend
+		cfg.Deliveries.Create(rec)
+		done := map[string]bool{}
+		err = deliverEnvelope(backend, body, &payload, fromAddress, msg.Envelope.To, done, msg)
+		if err != nil && done[toAddress] {
+			// Only blind copies failed. A retry by the sender would deliver
+			// the message to the recipient again, so keep the rest for replay.
+			cfg.Deliveries.RecordAttempt(id, err, false)
+			cfg.Deliveries.SetPending(id, pendingRecipients(msg.Envelope.To, done))
+			cfg.Deliveries.SaveDeadLetter(id, msg, body)
+			log.Printf("[%s] Email delivered to %s, but not to every blind copy: %v", id, toAddress, err)
+			err = nil
+		} else if err != nil {
+			// The sender retries temporary failures, so only keep permanent ones
+			derr := classifyDeliveryError(err)
+			temporary := derr != nil && derr.Temporary
+			cfg.Deliveries.RecordAttempt(id, err, temporary)
+			if derr != nil && !temporary {
+				cfg.Deliveries.SaveDeadLetter(id, msg, body)
 			}
-			lw.currentLine = 0
+		} else {
+			cfg.Deliveries.RecordAttempt(id, nil, false)
 		}
-		if _, err := lw.w.Write([]byte{b}); err != nil {
-			return i, err
+		if err != nil {
+			log.Printf("[%s] Error delivering email: %v", id, err)
+			writeDeliveryError(w, err)
+			return
 		}
-		lw.currentLine++
-	}
-	return len(p), nil
-}
+		delivered = true
 
-// generateBoundary creates a MIME boundary string
-func generateBoundary() string {
-	return fmt.Sprintf("----=_Part_%d_%d", time.Now().Unix(), time.Now().Nanosecond())
+		log.Printf("[%s] Email successfully delivered using %T", id, backend)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"status":"success","message":"Email delivered","id":"%s"}`, id)
+	}
 }
 
 // handleHome serves the home page
@@ -663,6 +1115,7 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
         <ul>
             <li><code>/health</code> - Service health and diagnostic information</li>
             <li><code>/webhook/email</code> - Core receiver for incoming ForwardEmail POST requests</li>
+            <li><code>/deliveries/{id}</code> - Delivery status lookup (requires API key)</li>
         </ul>
 
         <div style="text-align: center;">
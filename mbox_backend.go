@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// MboxBackend appends messages to mbox files for tools that still read them.
+// PathTemplate maps a recipient to a file, e.g. "/var/mail/{local}".
+// Files are locked with both fcntl and a .lock dotlock, like other mail tools.
+type MboxBackend struct {
+	PathTemplate string
+	LockTimeout  time.Duration
+}
+
+func (m *MboxBackend) Deliver(fromAddress, toAddress string, msg Message) error {
+	path, err := expandPathTemplate(m.PathTemplate, toAddress)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create mbox directory: %w", err)
+	}
+
+	timeout := m.LockTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	unlock, err := dotlock(path, timeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open mbox: %w", err)
+	}
+	defer f.Close()
+
+	if err := fcntlLock(f, timeout); err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat mbox: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	err = writeMboxMessage(w, fromAddress, time.Now(), msg)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		// Roll back a partial append so the mbox stays parseable
+		f.Truncate(info.Size())
+		return fmt.Errorf("failed to append to mbox: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync mbox: %w", err)
+	}
+
+	return nil
+}
+
+// writeMboxMessage writes a single mboxrd entry: the "From " separator, the
+// message with LF line endings and >From quoting, and a trailing blank line.
+func writeMboxMessage(w *bufio.Writer, fromAddress string, received time.Time, msg Message) error {
+	if fromAddress == "" {
+		fromAddress = "MAILER-DAEMON"
+	}
+	fmt.Fprintf(w, "From %s %s\n", fromAddress, received.UTC().Format(time.ANSIC))
+
+	r := messageReader(msg)
+	defer r.Close()
+	br := bufio.NewReaderSize(r, 64*1024)
+	atLineStart, heldCR := true, false
+	for {
+		// Lines longer than the buffer arrive in pieces; only the first
+		// piece of a line can need quoting, and a CR ending a piece is
+		// held back in case the next one starts with the LF
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			if heldCR && line[0] != '\n' {
+				w.WriteByte('\r')
+			}
+			heldCR = false
+			if atLineStart && isMboxFromLine(line) {
+				w.WriteByte('>')
+			}
+			atLineStart = line[len(line)-1] == '\n'
+			if atLineStart {
+				line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+			} else if line[len(line)-1] == '\r' {
+				line, heldCR = line[:len(line)-1], true
+			}
+			w.Write(line)
+			if atLineStart {
+				w.WriteByte('\n')
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+	if heldCR {
+		w.WriteByte('\r')
+	}
+	if !atLineStart {
+		w.WriteByte('\n')
+	}
+	w.WriteByte('\n')
+	return nil
+}
+
+// isMboxFromLine reports whether a line matches ^>*From  and must be quoted
+func isMboxFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
+
+// dotlock creates path.lock the way mail tools do, breaking stale locks
+// older than five minutes. The returned function removes the lock.
+func dotlock(path string, timeout time.Duration) (func(), error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(timeout)
+
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to create lock file %s: %w", lockPath, err)
+		}
+
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > 5*time.Minute {
+			os.Remove(lockPath)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, &DeliveryError{Temporary: true, Err: fmt.Errorf("timed out waiting for lock file %s", lockPath)}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMboxMessage(t *testing.T) {
+	received := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	long := strings.Repeat("x", 100*1024)
+	// The CR of this line's CRLF ends the first 64 KiB piece
+	split := strings.Repeat("y", 64*1024-1)
+
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{
+			"crlf",
+			"Subject: hi\r\n\r\nhello\r\nworld\r\n",
+			"Subject: hi\n\nhello\nworld\n",
+		},
+		{
+			"from quoting",
+			"Subject: hi\r\n\r\nFrom here\r\n>From there\r\n>>From everywhere\r\n From indented\r\nFromage\r\n",
+			"Subject: hi\n\n>From here\n>>From there\n>>>From everywhere\n From indented\nFromage\n",
+		},
+		{
+			"no final newline",
+			"Subject: hi\r\n\r\nhello",
+			"Subject: hi\n\nhello\n",
+		},
+		{
+			"long line",
+			"Subject: hi\r\n\r\n" + long + "From \r\nFrom " + long + "\r\n",
+			"Subject: hi\n\n" + long + "From \n>From " + long + "\n",
+		},
+		{
+			"crlf across pieces",
+			split + "\r\nnext\r\n",
+			split + "\nnext\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := bufio.NewWriter(&buf)
+			if err := writeMboxMessage(w, "sender@example.com", received, bytesMessage(tt.msg)); err != nil {
+				t.Fatal(err)
+			}
+			w.Flush()
+
+			want := "From sender@example.com Thu Jan  1 00:00:00 2026\n" + tt.want + "\n"
+			if got := buf.String(); got != want {
+				if len(got) > 200 || len(want) > 200 {
+					t.Errorf("got %d bytes, want %d", len(got), len(want))
+				} else {
+					t.Errorf("got %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMboxBackendAppends(t *testing.T) {
+	dir := t.TempDir()
+	backend := &MboxBackend{PathTemplate: filepath.Join(dir, "{domain}", "{local}")}
+	for _, body := range []string{"first", "second"} {
+		if err := backend.Deliver("sender@example.com", "rcpt@example.com", bytesMessage("Subject: hi\r\n\r\n"+body+"\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "example.com", "rcpt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\nFrom sender@example.com ") + 1; !strings.HasPrefix(string(data), "From ") || n != 2 {
+		t.Errorf("mbox has %d messages:\n%s", n, data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "example.com", "rcpt.lock")); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+}
+
+func TestDotlock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mbox")
+	lockPath := path + ".lock"
+	if err := os.WriteFile(lockPath, []byte("1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh lock is waited on until the timeout
+	start := time.Now()
+	_, err := dotlock(path, 200*time.Millisecond)
+	if derr := classifyDeliveryError(err); derr == nil || !derr.Temporary {
+		t.Fatalf("err = %v, want a temporary failure", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("gave up after %s", elapsed)
+	}
+
+	// A stale one is broken
+	old := time.Now().Add(-10 * time.Minute)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := dotlock(path, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("stale lock was not broken: %v", err)
+	}
+	info, err := os.Stat(lockPath)
+	if err != nil || time.Since(info.ModTime()) > time.Minute {
+		t.Errorf("lock not taken over: %v", err)
+	}
+	unlock()
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("unlock left the lock file: %v", err)
+	}
+}
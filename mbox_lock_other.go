@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fcntlLock is a no-op where POSIX record locks are unavailable; the
+// dotlock taken by MboxBackend still serialises writers.
+func fcntlLock(f *os.File, timeout time.Duration) error {
+	return nil
+}
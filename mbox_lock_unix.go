@@ -0,0 +1,31 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// fcntlLock takes an exclusive POSIX write lock on the whole file, retrying
+// until timeout. The lock is released when the file is closed.
+func fcntlLock(f *os.File, timeout time.Duration) error {
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 0, Len: 0}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
+		if err == nil {
+			return nil
+		}
+		if err != syscall.EAGAIN && err != syscall.EACCES {
+			return fmt.Errorf("failed to lock mbox: %w", err)
+		}
+		if time.Now().After(deadline) {
+			return &DeliveryError{Temporary: true, Err: fmt.Errorf("timed out waiting for mbox lock")}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"goapp/mailmsg"
+)
+
+// Message is an RFC822 message that backends stream to their destination
+// instead of receiving it as one buffer. WriteTo may be called several times
+// (retries, or a first pass to learn the size) and writes the same bytes
+// every time.
+type Message interface {
+	io.WriterTo
+}
+
+// bytesMessage is a message that is already fully rendered
+type bytesMessage []byte
+
+func (m bytesMessage) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(m)
+	return int64(n), err
+}
+
+// fileMessage is a message stored on disk, such as a dead letter
+type fileMessage string
+
+func (m fileMessage) WriteTo(w io.Writer) (int64, error) {
+	f, err := os.Open(string(m))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// traceHeaders selects the optional trace header fields added to messages
+type traceHeaders struct {
+	OriginalTo  bool // X-Original-To: the webhook's recipient
+	DeliveredTo bool // Delivered-To: the envelope recipient of each copy
+	RequestID   bool // X-Webhook-Request-Id: the delivery tracking ID
+}
+
+// parseTraceHeaders reads a list of trace header names, as in TRACE_HEADERS
+func parseTraceHeaders(names []string) (traceHeaders, error) {
+	var trace traceHeaders
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "x-original-to":
+			trace.OriginalTo = true
+		case "delivered-to":
+			trace.DeliveredTo = true
+		case "x-webhook-request-id":
+			trace.RequestID = true
+		default:
+			return trace, fmt.Errorf("unknown trace header %q", name)
+		}
+	}
+	return trace, nil
+}
+
+// messageContext is what the rebuilt message needs besides the payload
+type messageContext struct {
+	FromAddress string
+	ToAddress   string
+	Bcc         []string
+
+	// RequestID identifies the webhook request (the delivery tracking ID)
+	RequestID string
+	ClientIP  string
+	Hostname  string
+	Received  time.Time
+	Trace     traceHeaders
+}
+
+// buildMessage builds the message for a payload, delivered from
+// ctx.FromAddress to ctx.ToAddress and blind copied to ctx.Bcc. Attachments
+// must have been checked with attachmentErrors.
+func buildMessage(payload *WebhookPayload, ctx messageContext) (*mailmsg.Message, error) {
+	fromAddress, toAddress := ctx.FromAddress, ctx.ToAddress
+	envelopeTo := []string{toAddress}
+	for _, addr := range ctx.Bcc {
+		if !strings.EqualFold(addr, toAddress) {
+			envelopeTo = append(envelopeTo, addr)
+		}
+	}
+	p := &mailmsg.Payload{
+		EnvelopeFrom: fromAddress,
+		EnvelopeTo:   envelopeTo,
+		From:         payload.From.Text,
+		To:           toAddress,
+		Cc:           payload.Cc.Text,
+		Subject:      payload.Subject,
+		Date:         payload.Date,
+		MessageID:    payload.MessageID,
+		Hostname:     ctx.Hostname,
+		Received:     &mailmsg.Received{FromIP: ctx.ClientIP, ID: ctx.RequestID, Time: ctx.Received},
+		DeliveredTo:  ctx.Trace.DeliveredTo,
+		Text:         payload.Text,
+		HTML:         payload.HTML,
+		TextCharset:  payload.textCharset,
+		HTMLCharset:  payload.htmlCharset,
+	}
+	for _, att := range payload.Attachments {
+		p.Attachments = append(p.Attachments, mailmsg.Attachment{
+			Filename:    att.Filename,
+			ContentType: att.ContentType,
+			ContentID:   att.contentID(),
+			Inline:      att.Related || strings.EqualFold(att.ContentDisposition, "inline"),
+			Data:        att.Content.Data,
+		})
+	}
+	if ctx.Trace.OriginalTo {
+		p.OriginalTo = toAddress
+	}
+	if ctx.Trace.RequestID {
+		p.RequestID = ctx.RequestID
+	}
+	return mailmsg.Build(p)
+}
+
+// withMIMEOptions returns msg rendered for a transport accepting opts. Only
+// built messages can change; others are returned as is.
+func withMIMEOptions(msg Message, opts mailmsg.Options) Message {
+	if m, ok := msg.(*mailmsg.Message); ok {
+		return m.WithOptions(opts)
+	}
+	return msg
+}
+
+// forRecipient returns msg for delivery to rcpt, with trace headers naming
+// it when msg was built here
+func forRecipient(msg Message, rcpt string) Message {
+	if m, ok := msg.(*mailmsg.Message); ok {
+		return m.ForRecipient(rcpt)
+	}
+	return msg
+}
+
+// messageSize renders a message once, discarding it, to learn its size
+func messageSize(msg Message) (int64, error) {
+	return msg.WriteTo(io.Discard)
+}
+
+// messageReader returns a reader streaming msg from a separate goroutine.
+// The caller must close it, which also stops the writer if it has not been
+// read to the end.
+func messageReader(msg Message) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := msg.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// messageHeader parses just the header of a message
+func messageHeader(msg Message) (mail.Header, error) {
+	r := messageReader(msg)
+	defer r.Close()
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	return m.Header, nil
+}
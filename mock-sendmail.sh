@@ -2,10 +2,15 @@
 # Mock sendmail script for testing
 # Accepts standard sendmail parameters and displays the email content
 
-# Parse arguments (we accept -t -i but don't need to do anything with them)
-while getopts "ti" opt; do
+# Record the command line when asked, so tests can check it
+if [ -n "$MOCK_SENDMAIL_LOG" ]; then
+  echo "$*" >> "$MOCK_SENDMAIL_LOG"
+fi
+
+# Parse arguments (we accept -t -i -f but don't need to do anything with them)
+while getopts "tif:" opt; do
   case $opt in
-    t|i)
+    t|i|f)
       # These are standard sendmail options, just ignore them
       ;;
     \?)
@@ -14,6 +19,7 @@ while getopts "ti" opt; do
       ;;
   esac
 done
+shift $((OPTIND - 1))
 
 # Read the email from stdin and display it
 echo "=========================================="
@@ -22,7 +28,7 @@ echo "=========================================="
 cat
 echo ""
 echo "=========================================="
-echo "Email would be sent via sendmail"
+echo "Email would be sent via sendmail to: $*"
 echo "=========================================="
 
 exit 0
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Chat platforms supported by NotifierBackend
+const (
+	NotifySlack      = "slack"
+	NotifyMattermost = "mattermost"
+	NotifyMatrix     = "matrix"
+)
+
+// defaultNotifyTemplate is used when no template is configured. Fields are
+// already escaped for the target platform; bold renders platform emphasis.
+const defaultNotifyTemplate = `{{bold "New email"}} from {{.SenderName}} ({{.Sender}}) to {{.Recipient}}
+{{bold "Subject:"}} {{.Subject}}
+{{- range .Lines}}
+> {{.}}
+{{- end}}
+{{- if .Attachments}}
+{{bold "Attachments:"}} {{join .Attachments ", "}}
+{{- end}}`
+
+// NotifierBackend posts a short summary of each email to a chat incoming
+// webhook. If Next is set the email is delivered there first and the
+// notification is sent in addition; otherwise it replaces delivery.
+type NotifierBackend struct {
+	URL      string
+	Platform string
+	// Template is a text/template; see defaultNotifyTemplate for the fields
+	Template string
+	// MaxLines limits how many lines of the text body are included
+	MaxLines int
+	Timeout  time.Duration
+	Next     Backend
+
+	tmpl *template.Template
+}
+
+// notifyData is the data passed to the notification template
+type notifyData struct {
+	Sender      string
+	SenderName  string
+	Recipient   string
+	Subject     string
+	Lines       []string
+	Attachments []string
+}
+
+// NewNotifierBackend parses the template up front so mistakes surface at startup
+func NewNotifierBackend(url, platform, tmpl string, maxLines int, timeout time.Duration, next Backend) (*NotifierBackend, error) {
+	switch platform {
+	case NotifySlack, NotifyMattermost, NotifyMatrix:
+	default:
+		return nil, fmt.Errorf("unknown notification platform %q", platform)
+	}
+	if tmpl == "" {
+		tmpl = defaultNotifyTemplate
+	}
+	parsed, err := template.New("notify").Funcs(template.FuncMap{
+		"bold": func(s string) string { return s },
+		"join": strings.Join,
+	}).Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification template: %v", err)
+	}
+	return &NotifierBackend{
+		URL:      url,
+		Platform: platform,
+		Template: tmpl,
+		MaxLines: maxLines,
+		Timeout:  timeout,
+		Next:     next,
+		tmpl:     parsed,
+	}, nil
+}
+
+func (n *NotifierBackend) Deliver(fromAddress, toAddress string, msg Message) error {
+	return n.DeliverPayload(nil, nil, fromAddress, toAddress, msg)
+}
+
+func (n *NotifierBackend) DeliverPayload(rawBody []byte, payload *WebhookPayload, fromAddress, toAddress string, msg Message) error {
+	if n.Next != nil {
+		if err := deliver(n.Next, rawBody, payload, fromAddress, toAddress, msg); err != nil {
+			return err
+		}
+		n.Notify(payload, fromAddress, toAddress, msg)
+		return nil
+	}
+	return n.post(n.summarize(payload, fromAddress, toAddress, msg))
+}
+
+// DeliversOnce reports whether the notification replaces delivery, in which
+// case one per message is enough
+func (n *NotifierBackend) DeliversOnce() bool {
+	return n.Next == nil
+}
+
+// Unwrap returns the backend the email is delivered to before notifying
+func (n *NotifierBackend) Unwrap() Backend {
+	return n.Next
+}
+
+// NeedsRawBody reports whether Next wants the original webhook JSON
+func (n *NotifierBackend) NeedsRawBody() bool {
+	return n.Next != nil && needsRawBody(n.Next)
+}
+
+// Notify posts the summary of an email already delivered to Next. Failures
+// are only logged; failing now would only cause a duplicate on retry.
+func (n *NotifierBackend) Notify(payload *WebhookPayload, fromAddress, toAddress string, msg Message) {
+	if err := n.post(n.summarize(payload, fromAddress, toAddress, msg)); err != nil {
+		log.Printf("Warning: chat notification failed: %v", err)
+	}
+}
+
+// summarize extracts the template fields from the payload, or from the
+// message headers when no payload is available.
+func (n *NotifierBackend) summarize(payload *WebhookPayload, fromAddress, toAddress string, msg Message) notifyData {
+	data := notifyData{Sender: fromAddress, Recipient: toAddress}
+
+	if payload != nil {
+		data.Subject = payload.Subject
+		if len(payload.From.Value) > 0 {
+			data.SenderName = payload.From.Value[0].Name
+		}
+		data.Lines = firstLines(payload.Text, n.MaxLines)
+		for _, att := range payload.Attachments {
+			data.Attachments = append(data.Attachments, att.Filename)
+		}
+	} else if header, err := messageHeader(msg); err == nil {
+		data.Subject = header.Get("Subject")
+		if addr, err := mail.ParseAddress(header.Get("From")); err == nil {
+			data.SenderName = addr.Name
+		}
+	}
+
+	if data.SenderName == "" {
+		data.SenderName = fromAddress
+	}
+	return data
+}
+
+// firstLines returns up to limit non-empty lines of text
+func firstLines(text string, limit int) []string {
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() && len(lines) < limit {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// render executes the template with fields escaped and emphasis rendered for
+// one output dialect: "slack", "markdown", "html" or plain text.
+func (n *NotifierBackend) render(data notifyData, dialect string) (string, error) {
+	escape := func(s string) string { return s }
+	bold := func(s string) string { return s }
+	switch dialect {
+	case "slack":
+		escape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+		bold = func(s string) string { return "*" + s + "*" }
+	case "markdown":
+		escape = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`).Replace
+		bold = func(s string) string { return "**" + s + "**" }
+	case "html":
+		escape = html.EscapeString
+		bold = func(s string) string { return "<strong>" + s + "</strong>" }
+	}
+
+	escaped := notifyData{
+		Sender:     escape(data.Sender),
+		SenderName: escape(data.SenderName),
+		Recipient:  escape(data.Recipient),
+		Subject:    escape(data.Subject),
+	}
+	for _, l := range data.Lines {
+		escaped.Lines = append(escaped.Lines, escape(l))
+	}
+	for _, a := range data.Attachments {
+		escaped.Attachments = append(escaped.Attachments, escape(a))
+	}
+
+	var out bytes.Buffer
+	tmpl, err := n.tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	tmpl.Funcs(template.FuncMap{"bold": func(s string) string { return bold(escape(s)) }})
+	if err := tmpl.Execute(&out, escaped); err != nil {
+		return "", fmt.Errorf("failed to render notification: %v", err)
+	}
+	result := out.String()
+	if dialect == "html" {
+		result = strings.ReplaceAll(result, "\n", "<br>\n")
+	}
+	return result, nil
+}
+
+// post renders the message for the platform and sends it to the webhook
+func (n *NotifierBackend) post(data notifyData) error {
+	var body map[string]string
+	switch n.Platform {
+	case NotifySlack:
+		text, err := n.render(data, "slack")
+		if err != nil {
+			return err
+		}
+		body = map[string]string{"text": text}
+	case NotifyMattermost:
+		text, err := n.render(data, "markdown")
+		if err != nil {
+			return err
+		}
+		body = map[string]string{"text": text}
+	case NotifyMatrix:
+		text, err := n.render(data, "plain")
+		if err != nil {
+			return err
+		}
+		htmlText, err := n.render(data, "html")
+		if err != nil {
+			return err
+		}
+		body = map[string]string{"text": text, "html": htmlText}
+	}
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %v", err)
+	}
+
+	timeout := n.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(encoded))
+	if err != nil {
+		return fmt.Errorf("notification request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("notification webhook returned %d: %s", resp.StatusCode, snippet)
+	}
+	return nil
+}
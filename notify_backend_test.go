@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotifierWrapsNextBackend(t *testing.T) {
+	var posts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+	}))
+	defer srv.Close()
+
+	next := &recordingBackend{}
+	notifier, err := NewNotifierBackend(srv.URL, NotifySlack, "", 0, time.Second, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients := []string{"rcpt@example.com", "archive@example.com"}
+	done := map[string]bool{}
+	if err := deliverEnvelope(notifier, nil, nil, "sender@example.com", recipients, done, bytesMessage("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := next.deliveries(); len(got) != len(recipients) {
+		t.Errorf("Next got %v, want every recipient", got)
+	}
+	if n := posts.Load(); n != 1 {
+		t.Errorf("%d notifications, want 1", n)
+	}
+
+	if needsRawBody(notifier) {
+		t.Error("needsRawBody with an SMTP-like Next")
+	}
+	notifier.Next = &HTTPBackend{Format: HTTPFormatJSON}
+	if !needsRawBody(notifier) {
+		t.Error("needsRawBody is false with a JSON webhook as Next")
+	}
+}
+
+// notifyPayload has markup in every field the default template shows
+func notifyPayload() *WebhookPayload {
+	return &WebhookPayload{
+		Subject:     "a & <b> *c* _d_",
+		From:        AddressGroup{Value: []AddressEntry{{Address: "sender@example.com", Name: "Eve <admin>"}}},
+		Text:        "first & <line>\n\nsecond\nthird\nfourth",
+		Attachments: []EmailAttachment{{Filename: "report_[1].pdf"}},
+	}
+}
+
+// notifyServer records the JSON bodies posted to it and answers with status
+func notifyServer(t *testing.T, status int) (url string, bodies func() []map[string]string) {
+	var mu sync.Mutex
+	var got []map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("notification body: %v", err)
+		}
+		mu.Lock()
+		got = append(got, body)
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, func() []map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]map[string]string(nil), got...)
+	}
+}
+
+func TestNotifierRender(t *testing.T) {
+	tests := []struct {
+		platform string
+		field    string
+		contains []string
+		excludes []string
+	}{
+		{NotifySlack, "text", []string{
+			"*New email* from Eve &lt;admin&gt; (sender@example.com) to rcpt@example.com",
+			"*Subject:* a &amp; &lt;b&gt; *c* _d_",
+			"> first &amp; &lt;line&gt;\n> second\n*Attachments:*",
+		}, []string{"third", "<b>"}},
+		{NotifyMattermost, "text", []string{
+			"**New email** from Eve <admin> (sender@example.com)",
+			`**Subject:** a & <b> \*c\* \_d\_`,
+			`report\_\[1].pdf`,
+		}, []string{"third"}},
+		{NotifyMatrix, "text", []string{
+			"New email from Eve <admin> (sender@example.com)",
+			"Subject: a & <b> *c* _d_",
+		}, []string{"third", "<strong>"}},
+		{NotifyMatrix, "html", []string{
+			"<strong>New email</strong> from Eve &lt;admin&gt;",
+			"<strong>Subject:</strong> a &amp; &lt;b&gt; *c* _d_<br>\n",
+			"> first &amp; &lt;line&gt;<br>\n",
+		}, []string{"third", "<b>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.platform+" "+tt.field, func(t *testing.T) {
+			url, bodies := notifyServer(t, http.StatusOK)
+			notifier, err := NewNotifierBackend(url, tt.platform, "", 2, time.Second, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := notifier.DeliverPayload(nil, notifyPayload(), "sender@example.com", "rcpt@example.com", bytesMessage("")); err != nil {
+				t.Fatal(err)
+			}
+
+			got := bodies()
+			if len(got) != 1 {
+				t.Fatalf("%d notifications, want 1", len(got))
+			}
+			text := got[0][tt.field]
+			for _, want := range tt.contains {
+				if !strings.Contains(text, want) {
+					t.Errorf("%s lacks %q:\n%s", tt.field, want, text)
+				}
+			}
+			for _, unwanted := range tt.excludes {
+				if strings.Contains(text, unwanted) {
+					t.Errorf("%s contains %q:\n%s", tt.field, unwanted, text)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifierFailure(t *testing.T) {
+	url, bodies := notifyServer(t, http.StatusInternalServerError)
+
+	// Replacing delivery, a failed notification is a failed delivery
+	notifier, err := NewNotifierBackend(url, NotifySlack, "", 0, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Deliver("sender@example.com", "rcpt@example.com", bytesMessage("Subject: hi\r\n\r\nhello\r\n")); err == nil {
+		t.Error("failed notification without Next succeeded")
+	}
+
+	// In addition to delivery, it is only logged
+	next := &recordingBackend{}
+	notifier.Next = next
+	if err := notifier.Deliver("sender@example.com", "rcpt@example.com", bytesMessage("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Errorf("failed notification failed the delivery: %v", err)
+	}
+	if got := next.deliveries(); len(got) != 1 {
+		t.Errorf("Next got %v", got)
+	}
+	if n := len(bodies()); n != 2 {
+		t.Errorf("%d notifications, want 2", n)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// decodePayload parses a webhook payload from r token by token, so large
+// attachment byte arrays are decoded straight into []byte as they stream in
+// instead of being buffered as JSON and materialized as []int.
+func decodePayload(r io.Reader, payload *WebhookPayload) error {
+	dec := json.NewDecoder(r)
+	err := decodeObject(dec, payload, map[string]func(*json.Decoder) error{
+		"attachments": func(dec *json.Decoder) error {
+			return decodeAttachments(dec, &payload.Attachments)
+		},
+		"text": func(dec *json.Decoder) error {
+			return decodeRawString(dec, &payload.Text)
+		},
+		"html": func(dec *json.Decoder) error {
+			return decodeRawString(dec, &payload.HTML)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// The bodies are only known to be text once their charset is sorted out,
+	// which may depend on headers that came after them
+	declared := declaredCharset(payload.Headers)
+	payload.Text, payload.textCharset = decodeCharset(payload.Text, declared)
+	payload.HTML, payload.htmlCharset = decodeCharset(payload.HTML, declared)
+	return nil
+}
+
+// decodeRawString decodes a JSON string keeping any bytes that aren't valid
+// UTF-8, which encoding/json would replace with U+FFFD, so the body's real
+// charset can still be detected
+func decodeRawString(dec *json.Decoder, dst *string) error {
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	if string(raw) == "null" {
+		return nil
+	}
+	if len(raw) < 2 || raw[0] != '"' {
+		return fmt.Errorf("expected a string, got %.20s", raw)
+	}
+	s, err := unquoteJSON(raw[1 : len(raw)-1])
+	if err != nil {
+		return err
+	}
+	*dst = s
+	return nil
+}
+
+// unquoteJSON resolves the escapes in the contents of a JSON string,
+// copying all other bytes unchanged
+func unquoteJSON(s []byte) (string, error) {
+	if bytes.IndexByte(s, '\\') < 0 {
+		return string(s), nil
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("unterminated escape in string")
+		}
+		switch c := s[i]; c {
+		case '"', '\\', '/':
+			b = append(b, c)
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'u':
+			r, ok := hexRune(s[i+1:])
+			if !ok {
+				return "", fmt.Errorf("invalid \\u escape in string")
+			}
+			i += 4
+			if utf16.IsSurrogate(r) {
+				// The second half of a pair must follow as another \u escape
+				r2, ok := rune(0), false
+				if i+2 < len(s) && s[i+1] == '\\' && s[i+2] == 'u' {
+					r2, ok = hexRune(s[i+3:])
+				}
+				if r = utf16.DecodeRune(r, r2); ok && r != utf8.RuneError {
+					i += 6
+				}
+			}
+			b = utf8.AppendRune(b, r)
+		default:
+			return "", fmt.Errorf("invalid escape \\%c in string", c)
+		}
+	}
+	return string(b), nil
+}
+
+// hexRune parses the four hex digits of a \u escape
+func hexRune(s []byte) (rune, bool) {
+	if len(s) < 4 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(string(s[:4]), 16, 16)
+	if err != nil {
+		return 0, false
+	}
+	return rune(n), true
+}
+
+// decodeAttachments streams the attachments array
+func decodeAttachments(dec *json.Decoder, attachments *[]EmailAttachment) error {
+	if isNull, err := expectDelim(dec, '['); err != nil || isNull {
+		return err
+	}
+	for dec.More() {
+		var att EmailAttachment
+		err := decodeObject(dec, &att, map[string]func(*json.Decoder) error{
+			"content": func(dec *json.Decoder) error {
+				return decodeAttachmentContent(dec, &att.Content)
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("attachment %d: %w", len(*attachments), err)
+		}
+		// String content can only be decoded once the encoding field is known
+		att.Content.resolveText(att.Encoding)
+		*attachments = append(*attachments, att)
+	}
+	_, err := dec.Token() // closing ]
+	return err
+}
+
+// decodeAttachmentContent streams attachment content in any of the forms
+// producers send: a Node.js Buffer object, {"type":"Buffer","data":[104,...]},
+// or a bare byte array, appending each byte as it is read; or a string, kept
+// until resolveText knows its encoding. Content that is valid JSON but can't
+// be decoded is recorded in the content rather than failing the payload.
+func decodeAttachmentContent(dec *json.Decoder, content *AttachmentContent) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch v := tok.(type) {
+	case nil:
+		return nil
+	case string:
+		content.text, content.isText = v, true
+		return nil
+	case json.Delim:
+		if v == '[' {
+			return decodeBytes(dec, content)
+		}
+		return decodeFields(dec, content, map[string]func(*json.Decoder) error{
+			"data": func(dec *json.Decoder) error {
+				if isNull, err := expectDelim(dec, '['); err != nil || isNull {
+					return err
+				}
+				return decodeBytes(dec, content)
+			},
+		})
+	}
+	content.err = fmt.Errorf("unsupported content value %v", tok)
+	return nil
+}
+
+// decodeBytes reads the elements of a byte array up to its closing bracket.
+// An invalid element is recorded and the rest of the array skipped over.
+func decodeBytes(dec *json.Decoder, content *AttachmentContent) error {
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if content.err != nil {
+			continue
+		}
+		n, ok := tok.(float64)
+		if !ok || n < 0 || n > 255 || n != float64(int(n)) {
+			content.err = fmt.Errorf("invalid byte value %v in attachment data", tok)
+			content.Data = nil
+			continue
+		}
+		content.Data = append(content.Data, byte(n))
+	}
+	_, err := dec.Token() // closing ]
+	return err
+}
+
+// resolveText decodes string content according to the attachment's encoding:
+// "base64", or "utf8" to take the string as is. Without an encoding the
+// string is taken as is; guessing base64 would corrupt text such as "test"
+// that happens to be valid base64.
+func (c *AttachmentContent) resolveText(encoding string) {
+	if !c.isText {
+		return
+	}
+	text := c.text
+	c.text, c.isText = "", false
+
+	switch strings.ToLower(encoding) {
+	case "base64":
+		data, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			c.err = fmt.Errorf("invalid base64 content: %v", err)
+			return
+		}
+		c.Data = data
+	case "", "utf8", "utf-8":
+		c.Data = []byte(text)
+	default:
+		c.err = fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// Err reports why the content could not be decoded, or nil
+func (c *AttachmentContent) Err() error {
+	return c.err
+}
+
+// attachmentErrors lists the attachments whose content could not be decoded
+func (p *WebhookPayload) attachmentErrors() error {
+	var errs []error
+	for i, att := range p.Attachments {
+		if err := att.Content.Err(); err != nil {
+			errs = append(errs, fmt.Errorf("attachment %d (%s): %w", i, att.Filename, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// decodeObject decodes a JSON object into the struct pointed to by dst.
+// Keys with a handler in special are decoded by it; other keys are matched
+// to struct fields by their json tag (case-insensitively, like
+// encoding/json) and unknown keys are skipped.
+func decodeObject(dec *json.Decoder, dst interface{}, special map[string]func(*json.Decoder) error) error {
+	if isNull, err := expectDelim(dec, '{'); err != nil || isNull {
+		return err
+	}
+	return decodeFields(dec, dst, special)
+}
+
+// decodeFields decodes the members of an object whose opening brace has
+// already been read, like decodeObject.
+func decodeFields(dec *json.Decoder, dst interface{}, special map[string]func(*json.Decoder) error) error {
+	fields := jsonFields(dst)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+
+		if handler, ok := special[key]; ok {
+			if err := handler(dec); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			continue
+		}
+
+		if field, ok := fields[strings.ToLower(key)]; ok {
+			if err := dec.Decode(field); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			continue
+		}
+
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token() // closing }
+	return err
+}
+
+// jsonFields maps the lowercased json tag names of a struct to pointers to its fields
+func jsonFields(dst interface{}) map[string]interface{} {
+	v := reflect.ValueOf(dst).Elem()
+	t := v.Type()
+	fields := make(map[string]interface{}, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" || !t.Field(i).IsExported() {
+			continue
+		}
+		fields[strings.ToLower(name)] = v.Field(i).Addr().Interface()
+	}
+	return fields
+}
+
+// expectDelim reads the opening delimiter of an object or array. It
+// reports isNull for a JSON null, which leaves the value empty.
+func expectDelim(dec *json.Decoder, delim json.Delim) (isNull bool, err error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return false, err
+	}
+	if tok == nil {
+		return true, nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return false, fmt.Errorf("expected %v, got %v", delim, tok)
+	}
+	return false, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeAttachmentContentForms(t *testing.T) {
+	tests := []struct {
+		name    string
+		att     string
+		want    string
+		wantErr bool
+	}{
+		{"buffer", `{"content":{"type":"Buffer","data":[104,105]}}`, "hi", false},
+		{"byte array", `{"content":[104,105]}`, "hi", false},
+		{"base64-like string", `{"content":"test"}`, "test", false},
+		{"string", `{"content":"hi there!"}`, "hi there!", false},
+		{"base64 declared", `{"encoding":"base64","content":"aGk="}`, "hi", false},
+		{"encoding after content", `{"content":"aGk=","encoding":"utf8"}`, "aGk=", false},
+		{"null", `{"content":null}`, "", false},
+		{"invalid base64", `{"encoding":"base64","content":"not base64!"}`, "", true},
+		{"invalid byte", `{"content":{"type":"Buffer","data":[104,256,105]}}`, "", true},
+		{"unknown encoding", `{"encoding":"hex","content":"6869"}`, "", true},
+		{"number", `{"content":42}`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"subject":"s","attachments":[` + tt.att + `,{"filename":"next","encoding":"base64","content":"aGk="}]}`
+			var payload WebhookPayload
+			if err := decodePayload(strings.NewReader(body), &payload); err != nil {
+				t.Fatalf("decodePayload: %v", err)
+			}
+			if len(payload.Attachments) != 2 || string(payload.Attachments[1].Content.Data) != "hi" {
+				t.Fatalf("following attachment not decoded: %+v", payload.Attachments)
+			}
+			content := payload.Attachments[0].Content
+			if gotErr := content.Err() != nil; gotErr != tt.wantErr {
+				t.Fatalf("Err() = %v, want error %v", content.Err(), tt.wantErr)
+			}
+			if got := string(content.Data); got != tt.want {
+				t.Errorf("Data = %q, want %q", got, tt.want)
+			}
+			if tt.wantErr != (payload.attachmentErrors() != nil) {
+				t.Errorf("attachmentErrors() = %v", payload.attachmentErrors())
+			}
+		})
+	}
+}
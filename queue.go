@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// deliveryJob is a message waiting for asynchronous delivery
+type deliveryJob struct {
+	ID          string
+	FromAddress string
+	ToAddress   string
+	// Recipients is the whole envelope, ToAddress first (empty means just ToAddress)
+	Recipients []string
+	Message    Message
+	RawBody    []byte
+	Payload    *WebhookPayload
+
+	// dedupKey is finished in the dedup store once the job completes
+	dedupKey string
+	// delivered are the recipients that already have the message
+	delivered map[string]bool
+	// attempts counts the deliveries tried so far
+	attempts int
+}
+
+// DeliveryQueue is a bounded in-memory queue served by a fixed set of
+// workers. Temporary failures are retried with exponential backoff up to
+// maxAttempts; the webhook has already been acknowledged by then. A job
+// waiting to retry does not hold a worker.
+type DeliveryQueue struct {
+	backend     Backend
+	dedup       *DedupStore
+	deliveries  *DeliveryStore
+	jobs        chan *deliveryJob
+	maxAttempts int
+	// backoff is the wait before the first retry, doubling after each one
+	backoff time.Duration
+	// retries hands jobs whose backoff is over back to the workers
+	retries chan *deliveryJob
+	wg      sync.WaitGroup
+	closing chan struct{}
+
+	// mu guards closed, so Enqueue never sends on the closed jobs channel
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewDeliveryQueue starts workers goroutines consuming a queue of size jobs.
+// dedup and deliveries may be nil.
+func NewDeliveryQueue(backend Backend, dedup *DedupStore, deliveries *DeliveryStore, workers, size, maxAttempts int) *DeliveryQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	q := &DeliveryQueue{
+		backend:     backend,
+		dedup:       dedup,
+		deliveries:  deliveries,
+		jobs:        make(chan *deliveryJob, size),
+		maxAttempts: maxAttempts,
+		backoff:     30 * time.Second,
+		retries:     make(chan *deliveryJob),
+		closing:     make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	return q
+}
+
+// Enqueue adds a job without blocking; it returns false when the queue is
+// full or closed
+func (q *DeliveryQueue) Enqueue(job *deliveryJob) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false
+	}
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops accepting jobs and waits for the queued ones to be attempted.
+// Jobs waiting to retry give up instead of sleeping through their backoff.
+func (q *DeliveryQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	close(q.closing)
+	close(q.jobs)
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+func (q *DeliveryQueue) worker() {
+	defer q.wg.Done()
+	for {
+		select {
+		case job, ok := <-q.jobs:
+			if !ok {
+				return
+			}
+			q.process(job)
+		case job := <-q.retries:
+			q.process(job)
+		}
+	}
+}
+
+// process makes one delivery attempt for job, and schedules the next one
+// after a temporary failure
+func (q *DeliveryQueue) process(job *deliveryJob) {
+	if job.delivered == nil {
+		job.delivered = make(map[string]bool)
+	}
+	job.attempts++
+
+	q.deliveries.SetStatus(job.ID, StatusDelivering)
+	err := deliverEnvelope(q.backend, job.RawBody, job.Payload, job.FromAddress, job.recipients(), job.delivered, job.Message)
+	if err == nil {
+		q.deliveries.RecordAttempt(job.ID, nil, false)
+		log.Printf("[%s] Email successfully delivered using %T", job.ID, q.backend)
+		q.finish(job, true)
+		return
+	}
+
+	derr := classifyDeliveryError(err)
+	if derr == nil || !derr.Temporary || job.attempts >= q.maxAttempts {
+		q.deliveries.RecordAttempt(job.ID, err, false)
+		q.giveUp(job)
+		log.Printf("[%s] Error delivering email (attempt %d/%d, giving up): %v", job.ID, job.attempts, q.maxAttempts, err)
+		return
+	}
+	q.deliveries.RecordAttempt(job.ID, err, true)
+
+	backoff := time.Duration(1<<uint(job.attempts-1)) * q.backoff
+	log.Printf("[%s] Temporary delivery failure (attempt %d/%d), retrying in %s: %v", job.ID, job.attempts, q.maxAttempts, backoff, err)
+	q.wg.Add(1)
+	go q.retry(job, backoff)
+}
+
+// retry hands job back to the workers once backoff has passed, or gives up
+// on it when the queue is closed first
+func (q *DeliveryQueue) retry(job *deliveryJob, backoff time.Duration) {
+	defer q.wg.Done()
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		select {
+		case q.retries <- job:
+			return
+		case <-q.closing:
+		}
+	case <-q.closing:
+	}
+	log.Printf("[%s] Shutting down, abandoning retries", job.ID)
+	q.deliveries.SetStatus(job.ID, StatusFailed)
+	q.giveUp(job)
+}
+
+// giveUp keeps the message as a dead letter for the recipients that did
+// not get it
+func (q *DeliveryQueue) giveUp(job *deliveryJob) {
+	q.deliveries.SetPending(job.ID, pendingRecipients(job.recipients(), job.delivered))
+	q.deliveries.SaveDeadLetter(job.ID, job.Message, job.RawBody)
+	q.finish(job, false)
+}
+
+// finish releases the job's dedup key once it is delivered or abandoned
+func (q *DeliveryQueue) finish(job *deliveryJob, delivered bool) {
+	if q.dedup != nil && job.dedupKey != "" {
+		q.dedup.Finish(job.dedupKey, delivered)
+	}
+}
+
+// recipients returns the job's whole envelope
+func (job *deliveryJob) recipients() []string {
+	if len(job.Recipients) == 0 {
+		return []string{job.ToAddress}
+	}
+	return job.Recipients
+}
+
+// newTrackingID returns a random identifier for an accepted webhook
+func newTrackingID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyBackend fails the first failures deliveries with err, and blocks
+// each delivery until release is closed when it is set
+type flakyBackend struct {
+	failures int
+	err      error
+	started  chan struct{}
+	release  chan struct{}
+
+	mu       sync.Mutex
+	attempts int
+}
+
+func (b *flakyBackend) Deliver(fromAddress, toAddress string, msg Message) error {
+	if b.started != nil {
+		b.started <- struct{}{}
+	}
+	if b.release != nil {
+		<-b.release
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts++
+	if b.attempts <= b.failures {
+		return b.err
+	}
+	return nil
+}
+
+// waitForStatus polls the store until the delivery reaches status
+func waitForStatus(t *testing.T, store *DeliveryStore, id, status string) DeliveryRecord {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec, _ := store.Get(id)
+		if rec.Status == status {
+			return rec
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery %s is %q, want %q", id, rec.Status, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQueueEnqueueAfterClose(t *testing.T) {
+	q := NewDeliveryQueue(&recordingBackend{}, nil, nil, 1, 1, 1)
+	q.Close()
+	// A handler finishing after shutdown must be refused, not panic
+	if q.Enqueue(&deliveryJob{ID: "late", ToAddress: "rcpt@example.com"}) {
+		t.Error("Enqueue after Close accepted the job")
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	backend := &flakyBackend{started: make(chan struct{}, 1), release: make(chan struct{})}
+	q := NewDeliveryQueue(backend, nil, nil, 1, 1, 1)
+	defer q.Close()
+	defer close(backend.release)
+	cfg := webhookConfig{Backend: backend, Queue: q}
+
+	// The first job keeps the only worker busy, the second fills the queue
+	if w := postWebhook(cfg, testWebhookBody); w.Code != http.StatusAccepted {
+		t.Fatalf("first request: status = %d", w.Code)
+	}
+	<-backend.started
+	if w := postWebhook(cfg, testWebhookBody); w.Code != http.StatusAccepted {
+		t.Fatalf("second request: status = %d", w.Code)
+	}
+
+	w := postWebhook(cfg, testWebhookBody)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("full queue: status = %d, Retry-After = %q; want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestQueueRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		wantStatus   string
+		wantAttempts int
+	}{
+		{"temporary", &DeliveryError{Code: 451, Temporary: true, Err: fmt.Errorf("try later")}, StatusDelivered, 3},
+		{"permanent", &DeliveryError{Code: 550, Err: fmt.Errorf("no such user")}, StatusFailed, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewDeliveryStore("", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backend := &flakyBackend{failures: 2, err: tt.err}
+			q := NewDeliveryQueue(backend, nil, store, 1, 1, 3)
+			q.backoff = time.Millisecond
+			defer q.Close()
+
+			w := postWebhook(webhookConfig{Backend: backend, BackendType: "smtp", Queue: q, Deliveries: store}, testWebhookBody)
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("status = %d, want 202", w.Code)
+			}
+			rec := waitForStatus(t, store, w.Header().Get("X-Delivery-Id"), tt.wantStatus)
+			if rec.Attempts != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", rec.Attempts, tt.wantAttempts)
+			}
+			if rec.Backend != "smtp" {
+				t.Errorf("backend = %q, want the configured type", rec.Backend)
+			}
+		})
+	}
+}
+
+func TestQueueRetryFreesWorker(t *testing.T) {
+	store, err := NewDeliveryStore("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &recordingBackend{fail: map[string]error{
+		"slow@example.com": &DeliveryError{Code: 451, Temporary: true, Err: fmt.Errorf("try later")},
+	}}
+	q := NewDeliveryQueue(backend, nil, store, 1, 2, 3)
+	q.backoff = time.Hour
+	cfg := webhookConfig{Backend: backend, Queue: q, Deliveries: store}
+
+	slow := postWebhook(cfg, strings.Replace(testWebhookBody, "rcpt@example.com", "slow@example.com", 1))
+	waitForStatus(t, store, slow.Header().Get("X-Delivery-Id"), StatusRetrying)
+	// The only worker takes the next job while the first one waits
+	fast := postWebhook(cfg, testWebhookBody)
+	waitForStatus(t, store, fast.Header().Get("X-Delivery-Id"), StatusDelivered)
+
+	closed := make(chan struct{})
+	go func() {
+		q.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for the retry backoff")
+	}
+	rec, _ := store.Get(slow.Header().Get("X-Delivery-Id"))
+	if rec.Status != StatusFailed || rec.Attempts != 1 {
+		t.Errorf("abandoned job is %q after %d attempts, want failed after 1", rec.Status, rec.Attempts)
+	}
+}
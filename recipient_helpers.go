@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// splitAddress splits an email address into its local part and domain.
+// The domain is lowercased; the local part is returned as-is.
+func splitAddress(address string) (local, domain string) {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return address, ""
+	}
+	return address[:at], strings.ToLower(address[at+1:])
+}
+
+// checkAddresses rejects addresses containing CR, LF or other control
+// characters, which would end an SMTP or LMTP command early and let the
+// rest of the address be sent as commands of its own.
+func checkAddresses(addresses ...string) error {
+	for _, address := range addresses {
+		if strings.IndexFunc(address, isControl) >= 0 {
+			return &DeliveryError{EnhancedCode: "5.1.3", Err: fmt.Errorf("invalid address %q: contains control characters", address)}
+		}
+	}
+	return nil
+}
+
+// isControl reports whether r is an ASCII control character
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// expandPathTemplate fills {local}, {domain} and {address} in a filesystem
+// path template for the given recipient. Values that could escape the
+// intended directory (path separators, "..", leading dots) are rejected.
+func expandPathTemplate(template, address string) (string, error) {
+	local, domain := splitAddress(address)
+	for _, part := range []string{local, domain} {
+		if part == "" || strings.ContainsAny(part, "/\\\x00") || strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("recipient %q cannot be mapped to a path", address)
+		}
+	}
+
+	r := strings.NewReplacer(
+		"{local}", local,
+		"{domain}", domain,
+		"{address}", local+"@"+domain,
+	)
+	return r.Replace(template), nil
+}
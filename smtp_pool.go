@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// smtpHealthCheckAfter is how long a pooled session may sit idle before it is checked with NOOP
+const smtpHealthCheckAfter = 5 * time.Second
+
+// smtpCheckTimeout bounds the NOOP and RSET sent to pooled sessions, so a
+// server that stopped answering cannot hold up a delivery
+const smtpCheckTimeout = 10 * time.Second
+
+// smtpConn is an authenticated SMTP session that can be reused across deliveries
+type smtpConn struct {
+	client     *smtp.Client
+	conn       net.Conn
+	lastUsed   time.Time
+	messages   int
+	pipelining bool
+}
+
+// smtpPool keeps idle authenticated SMTP sessions for reuse by SMTPBackend
+type smtpPool struct {
+	backend *SMTPBackend
+
+	mu   sync.Mutex
+	idle []*smtpConn
+}
+
+func newSMTPPool(backend *SMTPBackend) *smtpPool {
+	return &smtpPool{backend: backend}
+}
+
+// get returns a ready-to-use session, reusing an idle one when it is still healthy
+func (p *smtpPool) get() (*smtpConn, error) {
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		// Take the most recently used session, it is the most likely to be alive
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if p.expired(c) {
+			c.close()
+			continue
+		}
+
+		// Health check sessions that have been sitting around for a while
+		if time.Since(c.lastUsed) > smtpHealthCheckAfter {
+			if err := c.check(c.client.Noop); err != nil {
+				log.Printf("Discarding pooled SMTP connection: NOOP failed: %v", err)
+				c.discard()
+				continue
+			}
+		}
+		return c, nil
+	}
+
+	return p.dial()
+}
+
+// put returns a session to the pool, resetting it for the next message
+func (p *smtpPool) put(c *smtpConn) {
+	c.lastUsed = time.Now()
+
+	if p.backend.PoolSize <= 0 || p.expired(c) {
+		c.close()
+		return
+	}
+
+	if err := c.check(c.client.Reset); err != nil {
+		log.Printf("Discarding pooled SMTP connection: RSET failed: %v", err)
+		c.discard()
+		return
+	}
+
+	p.mu.Lock()
+	if len(p.idle) >= p.backend.PoolSize {
+		p.mu.Unlock()
+		c.close()
+		return
+	}
+	p.idle = append(p.idle, c)
+	p.mu.Unlock()
+}
+
+// expired reports whether a session has reached its idle or message limits
+func (p *smtpPool) expired(c *smtpConn) bool {
+	if p.backend.MaxMessages > 0 && c.messages >= p.backend.MaxMessages {
+		return true
+	}
+	if p.backend.IdleTimeout > 0 && time.Since(c.lastUsed) > p.backend.IdleTimeout {
+		return true
+	}
+	return false
+}
+
+// dial opens a new session: connect, STARTTLS if supported, then authenticate
+func (p *smtpPool) dial() (*smtpConn, error) {
+	s := p.backend
+	addr := net.JoinHostPort(s.Host, s.Port)
+
+	// Connect to the remote SMTP server
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+
+	// STARTTLS if supported
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: s.SkipVerify,
+			ServerName:         s.Host,
+		}
+		if err = client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+
+	// Authentication if credentials provided
+	if s.User != "" {
+		auth := smtp.PlainAuth("", s.User, s.Password, s.Host)
+		if err = client.Auth(auth); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+
+	pipelining, _ := client.Extension("PIPELINING")
+
+	return &smtpConn{
+		client:     client,
+		conn:       conn,
+		lastUsed:   time.Now(),
+		pipelining: pipelining,
+	}, nil
+}
+
+// close ends the session politely with QUIT
+func (c *smtpConn) close() {
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := c.client.Quit(); err != nil {
+		c.client.Close()
+	}
+}
+
+// check runs a NOOP or RSET on the session within smtpCheckTimeout
+func (c *smtpConn) check(cmd func() error) error {
+	c.conn.SetDeadline(time.Now().Add(smtpCheckTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	return cmd()
+}
+
+// discard drops the session without attempting QUIT, used after protocol errors
+func (c *smtpConn) discard() {
+	c.client.Close()
+}
+
+// send runs a single mail transaction on the session
+func (c *smtpConn) send(fromAddress, toAddress string, msg Message) error {
+	c.conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	defer c.conn.SetDeadline(time.Time{})
+
+	var w io.WriteCloser
+	var err error
+	if c.pipelining {
+		w, err = c.startPipelined(fromAddress, toAddress)
+	} else {
+		w, err = c.start(fromAddress, toAddress)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err = msg.WriteTo(w); err != nil {
+		return fmt.Errorf("failed to write email data: %w", err)
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("failed to close data writer: %w", err)
+	}
+
+	c.messages++
+	return nil
+}
+
+// start issues MAIL, RCPT and DATA one command at a time
+func (c *smtpConn) start(fromAddress, toAddress string) (io.WriteCloser, error) {
+	if err := c.client.Mail(fromAddress); err != nil {
+		return nil, fmt.Errorf("MAIL FROM failed: %w", err)
+	}
+	if err := c.client.Rcpt(toAddress); err != nil {
+		return nil, fmt.Errorf("RCPT TO failed: %w", err)
+	}
+	w, err := c.client.Data()
+	if err != nil {
+		return nil, fmt.Errorf("DATA failed: %w", err)
+	}
+	return w, nil
+}
+
+// startPipelined sends MAIL, RCPT and DATA in a single batch (RFC 2920)
+// and then reads the three replies in order.
+func (c *smtpConn) startPipelined(fromAddress, toAddress string) (io.WriteCloser, error) {
+	text := c.client.Text
+
+	mailCmd := "MAIL FROM:<%s>"
+	if ok, _ := c.client.Extension("8BITMIME"); ok {
+		mailCmd += " BODY=8BITMIME"
+	}
+	if ok, _ := c.client.Extension("SMTPUTF8"); ok {
+		mailCmd += " SMTPUTF8"
+	}
+
+	// Queue the commands without waiting for replies
+	var ids [3]uint
+	var err error
+	if ids[0], err = text.Cmd(mailCmd, fromAddress); err != nil {
+		return nil, fmt.Errorf("MAIL FROM failed: %w", err)
+	}
+	if ids[1], err = text.Cmd("RCPT TO:<%s>", toAddress); err != nil {
+		return nil, fmt.Errorf("RCPT TO failed: %w", err)
+	}
+	if ids[2], err = text.Cmd("DATA"); err != nil {
+		return nil, fmt.Errorf("DATA failed: %w", err)
+	}
+
+	// Every reply must be read, even after a failure, to keep the session in sync
+	expect := [3]int{250, 25, 354}
+	names := [3]string{"MAIL FROM", "RCPT TO", "DATA"}
+	var firstErr error
+	for i, id := range ids {
+		text.StartResponse(id)
+		_, _, rerr := text.ReadResponse(expect[i])
+		text.EndResponse(id)
+		if rerr != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s failed: %w", names[i], rerr)
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return &pipelinedData{text: text, w: text.DotWriter()}, nil
+}
+
+// pipelinedData finishes a DATA command started by startPipelined
+type pipelinedData struct {
+	text *textproto.Conn
+	w    io.WriteCloser
+}
+
+func (d *pipelinedData) Write(p []byte) (int, error) {
+	return d.w.Write(p)
+}
+
+func (d *pipelinedData) Close() error {
+	if err := d.w.Close(); err != nil {
+		return err
+	}
+	_, _, err := d.text.ReadResponse(250)
+	return err
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an SMTP server that rejects recipients starting with "bad@".
+// With pipelining it reads MAIL, RCPT and DATA before answering any of
+// them, so a client that waits for each reply hangs.
+type fakeSMTP struct {
+	pipelining bool
+
+	mu       sync.Mutex
+	commands []string
+	messages int
+}
+
+func (f *fakeSMTP) serve(text *textproto.Conn) {
+	text.PrintfLine("220 fake ESMTP")
+	rejected := false
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, line)
+		f.mu.Unlock()
+
+		verb, _, _ := strings.Cut(strings.ToUpper(line), " ")
+		switch verb {
+		case "EHLO":
+			if f.pipelining {
+				text.PrintfLine("250-fake\r\n250-PIPELINING\r\n250 8BITMIME")
+			} else {
+				text.PrintfLine("250-fake\r\n250 8BITMIME")
+			}
+		case "MAIL":
+			rejected = false
+			if !f.pipelining {
+				text.PrintfLine("250 2.1.0 OK")
+				continue
+			}
+			rcpt, err1 := text.ReadLine()
+			data, err2 := text.ReadLine()
+			if err1 != nil || err2 != nil || data != "DATA" {
+				return
+			}
+			f.mu.Lock()
+			f.commands = append(f.commands, rcpt, data)
+			f.mu.Unlock()
+			rejected = strings.Contains(rcpt, "<bad@")
+			text.PrintfLine("250 2.1.0 OK")
+			if rejected {
+				text.PrintfLine("550 5.1.1 no such user")
+				text.PrintfLine("554 5.5.1 no valid recipients")
+				continue
+			}
+			text.PrintfLine("250 2.1.5 OK")
+			f.data(text)
+		case "RCPT":
+			rejected = strings.Contains(line, "<bad@")
+			if rejected {
+				text.PrintfLine("550 5.1.1 no such user")
+			} else {
+				text.PrintfLine("250 2.1.5 OK")
+			}
+		case "DATA":
+			if rejected {
+				text.PrintfLine("554 5.5.1 no valid recipients")
+				continue
+			}
+			f.data(text)
+		case "RSET", "NOOP":
+			text.PrintfLine("250 2.0.0 OK")
+		case "QUIT":
+			text.PrintfLine("221 2.0.0 bye")
+			return
+		default:
+			text.PrintfLine("502 5.5.2 not implemented")
+		}
+	}
+}
+
+// data answers DATA and reads the message
+func (f *fakeSMTP) data(text *textproto.Conn) {
+	text.PrintfLine("354 go ahead")
+	if _, err := text.ReadDotBytes(); err != nil {
+		return
+	}
+	f.mu.Lock()
+	f.messages++
+	f.mu.Unlock()
+	text.PrintfLine("250 2.0.0 queued")
+}
+
+// count returns how many times a command starting with verb was received
+func (f *fakeSMTP) count(verb string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, cmd := range f.commands {
+		if strings.HasPrefix(strings.ToUpper(cmd), verb) {
+			n++
+		}
+	}
+	return n
+}
+
+// newFakeSMTPBackend starts f and returns a pooling backend relaying to it
+func newFakeSMTPBackend(t *testing.T, f *fakeSMTP) (*SMTPBackend, func() int) {
+	addr, conns := fakeServer(t, f.serve)
+	host, port, _ := net.SplitHostPort(addr)
+	return &SMTPBackend{Host: host, Port: port, PoolSize: 2, IdleTimeout: time.Minute}, conns
+}
+
+// deliverWithin delivers one message, failing the test if it hangs
+func deliverWithin(t *testing.T, backend Backend, to string) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- backend.Deliver("sender@example.com", to, bytesMessage("Subject: hi\r\n\r\nhello\r\n"))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery hung")
+		return nil
+	}
+}
+
+func TestSMTPPoolReusesSessions(t *testing.T) {
+	f := &fakeSMTP{}
+	backend, conns := newFakeSMTPBackend(t, f)
+
+	for i := 0; i < 3; i++ {
+		if err := deliverWithin(t, backend, "rcpt@example.com"); err != nil {
+			t.Fatalf("delivery %d: %v", i, err)
+		}
+	}
+	if n := conns(); n != 1 {
+		t.Errorf("%d connections, want one reused session", n)
+	}
+	if n := f.count("RSET"); n != 3 {
+		t.Errorf("%d RSETs, want one after each message", n)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.messages != 3 {
+		t.Errorf("%d messages received, want 3", f.messages)
+	}
+}
+
+func TestSMTPPoolMaxMessages(t *testing.T) {
+	f := &fakeSMTP{}
+	backend, conns := newFakeSMTPBackend(t, f)
+	backend.MaxMessages = 2
+
+	for i := 0; i < 3; i++ {
+		if err := deliverWithin(t, backend, "rcpt@example.com"); err != nil {
+			t.Fatalf("delivery %d: %v", i, err)
+		}
+	}
+	if n := conns(); n != 2 {
+		t.Errorf("%d connections, want a new session after 2 messages", n)
+	}
+	if n := f.count("QUIT"); n != 1 {
+		t.Errorf("%d QUITs, want the full session closed", n)
+	}
+}
+
+func TestSMTPPipelinedReplies(t *testing.T) {
+	f := &fakeSMTP{pipelining: true}
+	backend, conns := newFakeSMTPBackend(t, f)
+
+	// Replies are matched to their commands across several transactions
+	for i := 0; i < 2; i++ {
+		if err := deliverWithin(t, backend, "rcpt@example.com"); err != nil {
+			t.Fatalf("delivery %d: %v", i, err)
+		}
+	}
+	if n := conns(); n != 1 {
+		t.Errorf("%d connections, want one reused session", n)
+	}
+
+	// A rejected recipient is reported with its own reply, not DATA's
+	err := deliverWithin(t, backend, "bad@example.com")
+	var derr *DeliveryError
+	if !errors.As(err, &derr) || derr.Code != 550 || derr.EnhancedCode != "5.1.1" || derr.Temporary {
+		t.Fatalf("err = %v, want permanent 550 5.1.1", err)
+	}
+
+	// The session with a failed transaction is not reused
+	if err := deliverWithin(t, backend, "rcpt@example.com"); err != nil {
+		t.Fatalf("delivery after rejection: %v", err)
+	}
+	if n := conns(); n != 2 {
+		t.Errorf("%d connections, want a fresh session after the failure", n)
+	}
+}
+
+func TestSMTPRejectsCommandInjection(t *testing.T) {
+	f := &fakeSMTP{pipelining: true}
+	backend, _ := newFakeSMTPBackend(t, f)
+
+	err := backend.Deliver("a@b>\r\nRCPT TO:<victim@example.com", "rcpt@example.com", bytesMessage("\r\nhello\r\n"))
+	var derr *DeliveryError
+	if !errors.As(err, &derr) || derr.Temporary {
+		t.Fatalf("err = %v, want a permanent *DeliveryError", err)
+	}
+	if n := f.count("MAIL") + f.count("RCPT"); n != 0 {
+		t.Errorf("%d commands sent for an invalid address", n)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+// Exit codes from sysexits.h, as used by sendmail, procmail, maildrop and
+// dovecot-lda to report why a delivery failed.
+const (
+	exUsage       = 64 // command line usage error
+	exDataErr     = 65 // data format error
+	exNoInput     = 66 // cannot open input
+	exNoUser      = 67 // addressee unknown
+	exNoHost      = 68 // host name unknown
+	exUnavailable = 69 // service unavailable
+	exSoftware    = 70 // internal software error
+	exOSErr       = 71 // system error (e.g. can't fork)
+	exOSFile      = 72 // critical OS file missing
+	exCantCreat   = 73 // can't create (user) output file
+	exIOErr       = 74 // input/output error
+	exTempFail    = 75 // temporary failure, user is invited to retry
+	exProtocol    = 76 // remote error in protocol
+	exNoPerm      = 77 // permission denied
+	exConfig      = 78 // configuration error
+)
+
+var sysexitNames = map[int]string{
+	exUsage:       "EX_USAGE",
+	exDataErr:     "EX_DATAERR",
+	exNoInput:     "EX_NOINPUT",
+	exNoUser:      "EX_NOUSER",
+	exNoHost:      "EX_NOHOST",
+	exUnavailable: "EX_UNAVAILABLE",
+	exSoftware:    "EX_SOFTWARE",
+	exOSErr:       "EX_OSERR",
+	exOSFile:      "EX_OSFILE",
+	exCantCreat:   "EX_CANTCREAT",
+	exIOErr:       "EX_IOERR",
+	exTempFail:    "EX_TEMPFAIL",
+	exProtocol:    "EX_PROTOCOL",
+	exNoPerm:      "EX_NOPERM",
+	exConfig:      "EX_CONFIG",
+}
+
+// defaultTemporaryExitCodes are the sysexits that mean "try again later";
+// any other non-zero exit is treated as a permanent failure.
+func defaultTemporaryExitCodes() map[int]bool {
+	return map[int]bool{
+		exOSErr:    true,
+		exIOErr:    true,
+		exTempFail: true,
+	}
+}
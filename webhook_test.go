@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhookBody is a minimal mailparser payload for rcpt@example.com
+const testWebhookBody = `{"from":{"value":[{"address":"sender@example.com"}],"text":"sender@example.com"},` +
+	`"recipients":["rcpt@example.com"],"subject":"hi","text":"hello","messageId":"<1@example.com>"}`
+
+// recordingBackend records deliveries and fails those to recipients in fail
+type recordingBackend struct {
+	mu        sync.Mutex
+	fail      map[string]error
+	delivered []string
+}
+
+func (b *recordingBackend) Deliver(fromAddress, toAddress string, msg Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.fail[toAddress]; err != nil {
+		return err
+	}
+	b.delivered = append(b.delivered, toAddress)
+	return nil
+}
+
+func (b *recordingBackend) deliveries() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.delivered...)
+}
+
+// postWebhook sends body to a handler built from cfg
+func postWebhook(cfg webhookConfig, body string) *httptest.ResponseRecorder {
+	if cfg.MaxBodySize == 0 {
+		cfg.MaxBodySize = 1 << 20
+	}
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	makeWebhookHandler(cfg)(w, req)
+	return w
+}
+
+func TestWebhookBlindCopyFailure(t *testing.T) {
+	store, err := NewDeliveryStore(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &recordingBackend{fail: map[string]error{
+		"archive@example.com": &DeliveryError{Code: 451, Temporary: true, Err: fmt.Errorf("try later")},
+	}}
+	cfg := webhookConfig{
+		Backend:     backend,
+		Deliveries:  store,
+		KeepRawBody: true,
+		Bcc:         []string{"archive@example.com"},
+	}
+
+	w := postWebhook(cfg, testWebhookBody)
+	// The sender must not retry, or the recipient would get the message twice
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if got := backend.deliveries(); len(got) != 1 || got[0] != "rcpt@example.com" {
+		t.Fatalf("delivered to %v", got)
+	}
+	rec, ok := store.Get(w.Header().Get("X-Delivery-Id"))
+	if !ok || len(rec.Pending) != 1 || rec.Pending[0] != "archive@example.com" {
+		t.Fatalf("record = %+v, want archive@example.com pending", rec)
+	}
+
+	// Replaying reaches the blind copy, and only it
+	backend.fail = nil
+	if err := replayDelivery(store, backend, rec); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if got := backend.deliveries(); len(got) != 2 || got[1] != "archive@example.com" {
+		t.Errorf("delivered to %v, want the archive added once", got)
+	}
+	if rec, _ := store.Get(rec.ID); rec.Status != StatusDelivered || len(rec.Pending) != 0 {
+		t.Errorf("after replay record = %+v", rec)
+	}
+}
+
+func TestWebhookDeadLettersOnlyPermanentFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantStored bool
+	}{
+		{"temporary", &DeliveryError{Code: 451, Temporary: true, Err: fmt.Errorf("try later")}, http.StatusServiceUnavailable, false},
+		{"permanent", &DeliveryError{Code: 550, Err: fmt.Errorf("no such user")}, http.StatusUnprocessableEntity, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewDeliveryStore(t.TempDir(), time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backend := &recordingBackend{fail: map[string]error{"rcpt@example.com": tt.err}}
+			w := postWebhook(webhookConfig{Backend: backend, Deliveries: store}, testWebhookBody)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			_, _, loadErr := store.LoadDeadLetter(w.Header().Get("X-Delivery-Id"))
+			if stored := loadErr == nil; stored != tt.wantStored {
+				t.Errorf("dead letter stored = %v, want %v", stored, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestWebhookBodyTooLarge(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"large payload", strings.Replace(testWebhookBody, "hello", strings.Repeat("x", 1000), 1)},
+		// The JSON fits, but the bytes after it do not
+		{"trailing data", testWebhookBody + strings.Repeat(" ", 1000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &recordingBackend{}
+			w := postWebhook(webhookConfig{Backend: backend, MaxBodySize: int64(len(testWebhookBody) + 10)}, tt.body)
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("status = %d, want 413", w.Code)
+			}
+			if got := backend.deliveries(); len(got) != 0 {
+				t.Errorf("delivered to %v", got)
+			}
+		})
+	}
+}
+
+func TestWebhookRejectsControlCharacters(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"sender", strings.Replace(testWebhookBody, `"sender@example.com"}`, `"sender@example.com\r\nRCPT TO:<victim@example.com>"}`, 1)},
+		{"recipient", strings.Replace(testWebhookBody, `["rcpt@example.com"]`, `["rcpt@example.com\nBcc: victim@example.com"]`, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &recordingBackend{}
+			w := postWebhook(webhookConfig{Backend: backend}, tt.body)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+			if got := backend.deliveries(); len(got) != 0 {
+				t.Errorf("delivered to %v", got)
+			}
+		})
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	const key = "secret"
+	sign := func(body string) string {
+		return fmt.Sprintf("%x", computeHMAC([]byte(body), key))
+	}
+	// Trailing bytes are not part of the JSON but are covered by the signature
+	body := testWebhookBody + "\n"
+	tests := []struct {
+		name      string
+		signature string
+		want      int
+	}{
+		{"valid", sign(body), http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"without trailing bytes", sign(testWebhookBody), http.StatusUnauthorized},
+		{"not hex", "zz", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &recordingBackend{}
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+			if tt.signature != "" {
+				req.Header.Set("X-Webhook-Signature", tt.signature)
+			}
+			w := httptest.NewRecorder()
+			makeWebhookHandler(webhookConfig{WebhookKey: key, Backend: backend, MaxBodySize: 1 << 20})(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if delivered := len(backend.deliveries()) > 0; delivered != (tt.want == http.StatusOK) {
+				t.Errorf("delivered = %v with status %d", delivered, w.Code)
+			}
+		})
+	}
+}